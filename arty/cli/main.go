@@ -0,0 +1,368 @@
+// cli is the arty command, it draws ops outside the browser, ops are read
+// as JSON lines of messages or of the timestamped records of the server
+// ops.log
+//
+//	go build -o arty ./arty/cli
+//	arty render -in ops.jsonl -out canvas.png
+//	arty render -in ops.jsonl -golden want.png
+//	arty svg -in data/rec/default.rec -out board.svg -scale 2
+//	arty send -in ops.jsonl -addr ws://localhost:4444/room/test
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+const usage = `usage: arty <command> [flags]
+
+commands:
+  render  draw ops on a canvas and write or compare a PNG
+  svg     draw ops as an SVG document, lines, shapes and text as vectors
+  send    connect to a server as a bot and send ops
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "render":
+		err = render(os.Args[2:])
+	case "svg":
+		err = svg(os.Args[2:])
+	case "send":
+		err = send(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func render(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	in := fs.String("in", "-", "ops file, - for stdin")
+	x := fs.Int("x", 0, "left edge of the region to write")
+	y := fs.Int("y", 0, "top edge of the region to write")
+	width := fs.Int("width", 800, "region width, 0 for the drawn extent")
+	height := fs.Int("height", 600, "region height, 0 for the drawn extent")
+	maxSize := fs.Int("max", 4096, "largest width and height, the drawn extent is scaled down to fit")
+	out := fs.String("out", "", "write the canvas to this PNG file")
+	golden := fs.String("golden", "", "compare the canvas with this PNG file")
+	fontDir := fs.String("fonts", "", "directory with extra TTF/OTF fonts")
+	fs.Parse(args)
+
+	if *out == "" && *golden == "" {
+		return errors.New("render: -out or -golden required")
+	}
+	if *maxSize <= 0 {
+		return errors.New("render: -max must be positive")
+	}
+	msgs, err := readOps(*in)
+	if err != nil {
+		return err
+	}
+	p, err := painter.New()
+	if err != nil {
+		return err
+	}
+	if *fontDir != "" {
+		if err := p.Fonts.LoadDir(*fontDir); err != nil {
+			return err
+		}
+	}
+	// history lets text edits replace their block
+	p.EnableHistory()
+	p.Init(painter.InitOP{})
+	for i, m := range msgs {
+		if err := p.HandleOP(m.Payload); err != nil {
+			return fmt.Errorf("op %d: %v", i+1, err)
+		}
+	}
+	r := image.Rect(*x, *y, *x+*width, *y+*height)
+	scale := 1.0
+	if *width <= 0 || *height <= 0 {
+		r = p.Extent()
+		if fit := fitScale(r, *maxSize); fit < scale {
+			log.Printf("scaling the extent %v by %g to fit in %d", r, fit, *maxSize)
+			scale = fit
+		}
+	}
+	if fitScale(r, *maxSize) < scale {
+		return fmt.Errorf("render: region %v is larger than -max %d", r, *maxSize)
+	}
+	img := p.ScaledRegion(r, scale)
+	if *out != "" {
+		if err := writePNG(*out, img); err != nil {
+			return err
+		}
+	}
+	if *golden != "" {
+		return compare(img, *golden)
+	}
+	return nil
+}
+
+// fitScale returns the scale fitting r in a square of size
+func fitScale(r image.Rectangle, size int) float64 {
+	return math.Min(float64(size)/float64(r.Dx()), float64(size)/float64(r.Dy()))
+}
+
+// compare fails if img doesn't match the PNG in name pixel by pixel
+func compare(img *image.RGBA, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	want, err := png.Decode(f)
+	if err != nil {
+		return err
+	}
+	b, wb := img.Bounds(), want.Bounds()
+	if b.Size() != wb.Size() {
+		return fmt.Errorf("size %v, golden is %v", b.Size(), wb.Size())
+	}
+	diff := 0
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r1, g1, b1, a1 := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			r2, g2, b2, a2 := want.At(wb.Min.X+x, wb.Min.Y+y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				diff++
+			}
+		}
+	}
+	if diff > 0 {
+		return fmt.Errorf("%d pixels differ from %s", diff, name)
+	}
+	return nil
+}
+
+func svg(args []string) error {
+	fs := flag.NewFlagSet("svg", flag.ExitOnError)
+	in := fs.String("in", "-", "ops file or server -record recording, - for stdin, a room ops.log lacks the ops before its snapshot")
+	x := fs.Int("x", 0, "left edge of the region to write")
+	y := fs.Int("y", 0, "top edge of the region to write")
+	width := fs.Int("width", 0, "region width, 0 for the drawn extent")
+	height := fs.Int("height", 0, "region height, 0 for the drawn extent")
+	scale := fs.Float64("scale", 1, "document size per canvas pixel")
+	out := fs.String("out", "-", "SVG file, - for stdout")
+	fontDir := fs.String("fonts", "", "directory with extra TTF/OTF fonts")
+	fs.Parse(args)
+
+	if *scale <= 0 {
+		return errors.New("svg: -scale must be positive")
+	}
+	msgs, err := readOps(*in)
+	if err != nil {
+		return err
+	}
+	fonts, err := painter.NewFontCache()
+	if err != nil {
+		return err
+	}
+	if *fontDir != "" {
+		if err := fonts.LoadDir(*fontDir); err != nil {
+			return err
+		}
+	}
+	doc, err := painter.NewSVG(fonts)
+	if err != nil {
+		return err
+	}
+	for i, m := range msgs {
+		if err := doc.HandleOP(m.Payload); err != nil {
+			return fmt.Errorf("op %d: %v", i+1, err)
+		}
+	}
+	r := image.Rect(*x, *y, *x+*width, *y+*height)
+	if *width <= 0 || *height <= 0 {
+		r = image.Rectangle{}
+	}
+	if *out == "-" {
+		return doc.Encode(os.Stdout, r, *scale)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := doc.Encode(f, r, *scale); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func send(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	in := fs.String("in", "-", "ops file, - for stdin")
+	addr := fs.String("addr", "ws://localhost:4444/", "room websocket address")
+	rate := fs.Float64("rate", 50, "ops per second, keep it under the server -oprate")
+	timeout := fs.Duration("timeout", 10*time.Second, "time to wait for the server to confirm the ops")
+	fs.Parse(args)
+
+	if *rate <= 0 {
+		return errors.New("send: -rate must be positive")
+	}
+	msgs, err := readOps(*in)
+	if err != nil {
+		return err
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		Subprotocols:     []string{string(painter.CodecBinary), string(painter.CodecJSON)},
+	}
+	conn, _, err := dialer.Dial(*addr, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	codec := painter.ParseCodec(conn.Subprotocol())
+	mt := websocket.TextMessage
+	if codec == painter.CodecBinary {
+		mt = websocket.BinaryMessage
+	}
+
+	// acks receives the server answer to each of our messages, it holds
+	// all of them so the reader keeps answering pings while we write
+	acks := make(chan painter.Message, len(msgs))
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			m, err := painter.Decode(data)
+			if err != nil || m.Ref == 0 {
+				continue
+			}
+			acks <- m
+		}
+	}()
+
+	tick := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer tick.Stop()
+	// lines maps each Ref to its op position in the input
+	lines := map[uint32]int{}
+	sent := uint32(0)
+	for i, m := range msgs {
+		<-tick.C
+		ack := true
+		switch o := m.Payload.(type) {
+		case painter.InitOP:
+			// The room already has a size
+			continue
+		case painter.UndoOP, painter.RedoOP:
+			// Answered with tiles, not with an echo
+			ack = false
+		case painter.TextOP:
+			// An edit might be answered with tiles too
+			ack = !o.Edit
+		}
+		m.Ref = 0
+		if ack {
+			sent++
+			m.Ref = sent
+			lines[sent] = i + 1
+		}
+		buf, err := codec.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteMessage(mt, buf); err != nil {
+			return err
+		}
+	}
+
+	accepted, rejected := 0, 0
+	deadline := time.After(*timeout)
+	for accepted+rejected < int(sent) {
+		select {
+		case m := <-acks:
+			if e, ok := m.Payload.(painter.ErrorOP); ok {
+				log.Printf("op %d rejected: %v", lines[m.Ref], e)
+				rejected++
+				continue
+			}
+			accepted++
+		case err := <-readErr:
+			return err
+		case <-deadline:
+			return fmt.Errorf("timeout, %d of %d ops confirmed", accepted+rejected, sent)
+		}
+	}
+	log.Printf("%d ops accepted, %d rejected", accepted, rejected)
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	if rejected > 0 {
+		return fmt.Errorf("%d ops rejected", rejected)
+	}
+	return nil
+}
+
+// readOps reads JSON messages from name, - reads stdin
+func readOps(name string) ([]painter.Message, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	ret := []painter.Message{}
+	dec := json.NewDecoder(r)
+	for {
+		raw := json.RawMessage{}
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return ret, nil
+		}
+		rec := painter.Record{}
+		if err == nil {
+			err = json.Unmarshal(raw, &rec)
+		}
+		if err == nil && rec.Message.Payload == nil {
+			err = json.Unmarshal(raw, &rec.Message)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("op %d: %v", len(ret)+1, err)
+		}
+		ret = append(ret, rec.Message)
+	}
+}
+
+func writePNG(name string, img image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -3,11 +3,17 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"fmt"
+	"image"
 	"image/color"
 	"log"
+	"math"
 	"strconv"
+	"sync"
 	"syscall/js"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stdiopt/gowasm-experiments/arty/painter"
 
@@ -15,7 +21,23 @@ import (
 )
 
 func main() {
-	c, err := NewCanvasClient("wss:/arty.us.hexasoftware.com")
+	addr := "wss:/arty.us.hexasoftware.com"
+	// ?room=name joins a named room
+	params := js.Global().Get("URLSearchParams").New(js.Global().Get("location").Get("search"))
+	if room := params.Call("get", "room"); room.Type() == js.TypeString {
+		addr += "/room/" + js.Global().Call("encodeURIComponent", room).String()
+	}
+	// ?name= is the name shown to other users and ?token= grants a role
+	query := js.Global().Get("URLSearchParams").New()
+	for _, k := range []string{"name", "token"} {
+		if v := params.Call("get", k); v.Type() == js.TypeString {
+			query.Call("set", k, v)
+		}
+	}
+	if q := query.Call("toString").String(); q != "" {
+		addr += "?" + q
+	}
+	c, err := NewCanvasClient(addr)
 	if err != nil {
 		log.Fatal("could not start", err)
 	}
@@ -29,21 +51,68 @@ type pos struct {
 
 type CanvasClient struct {
 	done    chan struct{}
-	painter *painter.BufPainter
+	replica *painter.Replica
 	addr    string
 
 	doc      js.Value
 	canvasEl js.Value
 	ctx      js.Value
 	ws       js.Value
+	codec    painter.Codec
 	im       js.Value
 	// will hold js part of the image
 	byteArray js.Value
+	// frame is the canvas region shown, drawn scaled from buffer
+	frame     *image.RGBA
+	buffer    js.Value
+	bufferCtx js.Value
+	// pan is the canvas point at the top left of the screen
+	pan     pos
+	zoom    float64
+	gesture gesture
+	// moved is set when the view moved and the buffer needs a full redraw
+	moved bool
+
+	// users in the room by id, self is ours, drawn on overlay
+	peers        map[string]*peer
+	self         string
+	role         uint8
+	hasClearTool bool
+	eventsOnce   sync.Once
+	overlay      js.Value
+	overlayCtx   js.Value
+	peersMoved   bool
+	// our cursor, see moveCursor
+	cursorAt    pos
+	cursorMoved bool
+	cursorSent  time.Time
+	// view is the range of chunks the server sends us
+	view image.Rectangle
 
 	colorHex  string
 	lineWidth float64
+	tool      string
+	fill      bool
+	// layer ops are drawn on, empty for the bottom one
+	layer string
+	// layers shown in the layer controls
+	layers []painter.LayerInfo
+	// current stroke, increased on every mouse down
+	stroke int
+	// points of the pen stroke being drawn, sent on mouse up
+	points []painter.Point
+	// brush settings and the brush stroke being drawn
+	opacity    uint8
+	hardness   float64
+	texture    string
+	brushPts   []painter.BrushPoint
+	brushMoved bool
+	// where the current shape started
+	start pos
 
-	textOff pos
+	// text block being typed at lastPos
+	text    string
+	align   uint8
 	lastPos pos
 	width   float64
 	height  float64
@@ -52,15 +121,20 @@ type CanvasClient struct {
 func NewCanvasClient(addr string) (*CanvasClient, error) {
 	done := make(chan struct{})
 
-	painter, err := painter.New()
+	replica, err := painter.NewReplica()
 	if err != nil {
 		return nil, err
 	}
 	return &CanvasClient{
 		done:      done,
-		painter:   painter,
+		replica:   replica,
 		addr:      addr,
 		lineWidth: 10,
+		tool:      "pen",
+		opacity:   255,
+		hardness:  0.5,
+		zoom:      1,
+		peers:     map[string]*peer{},
 	}, nil
 }
 
@@ -79,16 +153,22 @@ func (c *CanvasClient) Close() {
 func (c *CanvasClient) initCanvas() {
 	c.doc = js.Global().Get("document")
 	c.canvasEl = c.doc.Call("getElementById", "mycanvas")
-	c.width = c.canvasEl.Get("width").Float()
-	c.height = c.canvasEl.Get("height").Float()
+	c.overlay = c.doc.Call("getElementById", "overlay")
+	c.overlayCtx = c.overlay.Call("getContext", "2d")
+	c.resize()
 	c.ctx = c.canvasEl.Call("getContext", "2d")
-	c.im = c.ctx.Call("createImageData", 1, 1)
-	c.byteArray = js.Global().Get("Uint8Array").New(1 * 4)
-	c.painter.OnInit = func(m painter.InitOP) {
-		c.im = c.ctx.Call("createImageData", m.Width, m.Height)
-		c.byteArray = js.Global().Get("Uint8Array").New(m.Width * m.Height * 4)
+	c.buffer = c.doc.Call("createElement", "canvas")
+	c.bufferCtx = c.buffer.Call("getContext", "2d")
+	c.replica.View.OnInit = func(m painter.InitOP) {
+		// Allocated on the first draw
+		c.frame = image.NewRGBA(image.Rectangle{})
+		c.moved = true
+		// A new canvas, nothing was seen yet
+		c.view = image.Rectangle{}
+		c.updateView()
 		c.SetStatus("connected")
-		c.initEvents()
+		// Also sent when the canvas is cleared
+		c.eventsOnce.Do(c.initEvents)
 	}
 }
 
@@ -110,19 +190,54 @@ func (c *CanvasClient) initFrameUpdate() {
 func (c *CanvasClient) initConnection() {
 	go func() {
 		c.SetStatus("connecting...")
-		c.ws = js.Global().Get("WebSocket").New(c.addr)
+		protocols := []interface{}{}
+		for _, p := range painter.Codecs {
+			protocols = append(protocols, string(p))
+		}
+		c.ws = js.Global().Get("WebSocket").New(c.addr, protocols)
+		c.ws.Set("binaryType", "arraybuffer")
 		onopen := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-			c.SetStatus("receiving... (it takes some time)")
+			c.codec = painter.ParseCodec(c.ws.Get("protocol").String())
+			c.SetStatus("receiving...")
 			return nil
 		})
 		defer onopen.Release()
 		onmessage := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-			c.painter.HandleRaw([]byte(args[0].Get("data").String()))
+			data := args[0].Get("data")
+			var buf []byte
+			if data.Type() == js.TypeString {
+				buf = []byte(data.String())
+			} else {
+				arr := js.Global().Get("Uint8Array").New(data)
+				buf = make([]byte, arr.Get("length").Int())
+				js.CopyBytesToGo(buf, arr)
+			}
+			m, err := painter.Decode(buf)
+			if err != nil {
+				log.Println("decode error", err)
+				return nil
+			}
+			if c.presence(m) {
+				return nil
+			}
+			if err := c.replica.Remote(m); err != nil {
+				log.Println("server:", err)
+				if _, ok := err.(painter.ErrorOP); ok {
+					c.SetStatus("rejected: " + err.Error())
+				}
+			}
 			return nil
 		})
 		defer onmessage.Release()
+		// i.e. when kicked
+		onclose := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.SetStatus("disconnected " + args[0].Get("reason").String())
+			return nil
+		})
+		defer onclose.Release()
 		c.ws.Set("onopen", onopen)
 		c.ws.Set("onmessage", onmessage)
+		c.ws.Set("onclose", onclose)
 
 		<-c.done
 	}()
@@ -142,110 +257,700 @@ func (c *CanvasClient) initEvents() {
 			return nil
 		})
 		defer szEvt.Release()
+		toolEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.tool = args[0].Get("target").Get("value").String()
+			return nil
+		})
+		defer toolEvt.Release()
+		fillEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.fill = args[0].Get("target").Get("checked").Bool()
+			return nil
+		})
+		defer fillEvt.Release()
+		alignEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			v, _ := strconv.Atoi(args[0].Get("target").Get("value").String())
+			c.align = uint8(v)
+			if c.text != "" {
+				c.sendText()
+			}
+			return nil
+		})
+		defer alignEvt.Release()
 
 		c.doc.Call("getElementById", "color").Call("addEventListener", "change", colorEvt)
 		c.doc.Call("getElementById", "size").Call("addEventListener", "change", szEvt)
+		c.doc.Call("getElementById", "tool").Call("addEventListener", "change", toolEvt)
+		c.doc.Call("getElementById", "fill").Call("addEventListener", "change", fillEvt)
+		c.doc.Call("getElementById", "align").Call("addEventListener", "change", alignEvt)
+
+		brushOpacityEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			v, _ := strconv.Atoi(args[0].Get("target").Get("value").String())
+			c.opacity = uint8(v)
+			return nil
+		})
+		defer brushOpacityEvt.Release()
+		brushHardnessEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			v, _ := strconv.ParseFloat(args[0].Get("target").Get("value").String(), 64)
+			c.hardness = v / 100
+			return nil
+		})
+		defer brushHardnessEvt.Release()
+		brushTextureEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.texture = args[0].Get("target").Get("value").String()
+			return nil
+		})
+		defer brushTextureEvt.Release()
+		c.doc.Call("getElementById", "brush-opacity").Call("addEventListener", "change", brushOpacityEvt)
+		c.doc.Call("getElementById", "brush-hardness").Call("addEventListener", "change", brushHardnessEvt)
+		c.doc.Call("getElementById", "brush-texture").Call("addEventListener", "change", brushTextureEvt)
+
+		// Layer controls act on the selected layer
+		layerEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.layer = args[0].Get("target").Get("value").String()
+			c.showLayer()
+			return nil
+		})
+		defer layerEvt.Release()
+		layerAddEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			name := ""
+			for n := len(c.layers) + 1; name == "" || c.layerIndex(name) != -1; n++ {
+				name = "layer " + strconv.Itoa(n)
+			}
+			c.apply(painter.LayerOP{
+				LayerInfo: painter.LayerInfo{Name: name, Opacity: 255},
+				At:        len(c.layers),
+			})
+			c.layer = name
+			return nil
+		})
+		defer layerAddEvt.Release()
+		layerDelEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			info, _ := c.currentLayer()
+			c.apply(painter.LayerOP{LayerInfo: info, Delete: true})
+			return nil
+		})
+		defer layerDelEvt.Release()
+		layerHiddenEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			hidden := args[0].Get("target").Get("checked").Bool()
+			c.updateLayer(func(l *painter.LayerInfo) { l.Hidden = hidden })
+			return nil
+		})
+		defer layerHiddenEvt.Release()
+		layerOpacityEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			v, _ := strconv.Atoi(args[0].Get("target").Get("value").String())
+			c.updateLayer(func(l *painter.LayerInfo) { l.Opacity = uint8(v) })
+			return nil
+		})
+		defer layerOpacityEvt.Release()
+		layerBlendEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			v, _ := strconv.Atoi(args[0].Get("target").Get("value").String())
+			c.updateLayer(func(l *painter.LayerInfo) { l.Blend = uint8(v) })
+			return nil
+		})
+		defer layerBlendEvt.Release()
+
+		c.doc.Call("getElementById", "layer").Call("addEventListener", "change", layerEvt)
+		c.doc.Call("getElementById", "layer-add").Call("addEventListener", "click", layerAddEvt)
+		c.doc.Call("getElementById", "layer-del").Call("addEventListener", "click", layerDelEvt)
+		c.doc.Call("getElementById", "layer-hidden").Call("addEventListener", "change", layerHiddenEvt)
+		c.doc.Call("getElementById", "layer-opacity").Call("addEventListener", "change", layerOpacityEvt)
+		c.doc.Call("getElementById", "layer-blend").Call("addEventListener", "change", layerBlendEvt)
 
 		// Input events
 		mouseDown := false
 		mouseDownEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 			e := args[0]
-			if e.Get("target") != c.canvasEl || e.Get("buttons").Float() != 1 {
+			if e.Get("target") != c.canvasEl {
 				return nil
 			}
-			mouseDown = true
-			if !e.Get("shiftKey").Bool() {
-				c.lastPos.x = e.Get("pageX").Float()
-				c.lastPos.y = e.Get("pageY").Float()
-				c.textOff = pos{} // reset
+			if c.gestureDown(e) {
+				// A second touch turns the stroke into a pinch
+				if mouseDown {
+					mouseDown = false
+					c.cancelStroke()
+				}
+				return nil
+			}
+			if e.Get("buttons").Float() != 1 || !c.canDraw() {
 				return nil
 			}
-			c.drawAtPointer(e)
+			mouseDown = true
+			c.stroke++
+			pointer := c.pointer(e)
+			switch c.tool {
+			case "fill":
+				mouseDown = false
+				c.apply(painter.FloodFillOP{
+					Attr:  c.attr(),
+					Color: c.color(),
+					X:     int(pointer.x),
+					Y:     int(pointer.y),
+				})
+			case "rect", "ellipse", "clear":
+				c.start = pointer
+			case "brush", "eraser":
+				c.brushPts = []painter.BrushPoint{c.brushPoint(e)}
+				c.brushMoved = true
+			default:
+				c.points = nil
+				if !e.Get("shiftKey").Bool() {
+					c.lastPos = pointer
+					c.text = "" // new text block
+					c.points = []painter.Point{{X: pointer.x, Y: pointer.y}}
+					return nil
+				}
+				c.points = []painter.Point{{X: c.lastPos.x, Y: c.lastPos.y}}
+				c.drawAtPointer(e)
+			}
 			return nil
 		})
 		defer mouseDownEvt.Release()
 
 		mouseUpEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			e := args[0]
+			if c.gestureUp(e) || !mouseDown {
+				return nil
+			}
 			mouseDown = false
+			pointer := c.pointer(e)
+			attr := c.attr()
+			switch c.tool {
+			case "rect":
+				c.apply(painter.RectOP{
+					Attr:  attr,
+					Color: c.color(),
+					Width: c.lineWidth,
+					Fill:  c.fill,
+					X1:    c.start.x,
+					Y1:    c.start.y,
+					X2:    pointer.x,
+					Y2:    pointer.y,
+				})
+			case "ellipse":
+				c.apply(painter.EllipseOP{
+					Attr:  attr,
+					Color: c.color(),
+					Width: c.lineWidth,
+					Fill:  c.fill,
+					X:     (c.start.x + pointer.x) / 2,
+					Y:     (c.start.y + pointer.y) / 2,
+					RX:    math.Abs(pointer.x-c.start.x) / 2,
+					RY:    math.Abs(pointer.y-c.start.y) / 2,
+				})
+			case "clear":
+				c.apply(painter.ClearRectOP{
+					Attr:   attr,
+					X:      int(math.Floor(math.Min(c.start.x, pointer.x))),
+					Y:      int(math.Floor(math.Min(c.start.y, pointer.y))),
+					Width:  int(math.Ceil(math.Abs(pointer.x - c.start.x))),
+					Height: int(math.Ceil(math.Abs(pointer.y - c.start.y))),
+				})
+			case "brush", "eraser":
+				// The preview was drawn on the view
+				c.replica.Invalidate()
+				c.apply(c.brushOP())
+				c.brushPts = nil
+			default:
+				if len(c.points) < 2 {
+					return nil
+				}
+				c.apply(painter.PolylineOP{
+					Attr:   attr,
+					Color:  c.color(),
+					Width:  c.lineWidth,
+					Points: c.points,
+				})
+				c.points = nil
+			}
 			return nil
 		})
 		defer mouseUpEvt.Release()
 
 		mouseMoveEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-			if !mouseDown {
+			if args[0].Get("target").Equal(c.canvasEl) {
+				c.moveCursor(c.pointer(args[0]))
+			}
+			if c.gestureMove(args[0]) || !mouseDown {
 				return nil
 			}
-			c.drawAtPointer(args[0])
+			switch c.tool {
+			case "pen":
+				c.drawAtPointer(args[0])
+			case "brush", "eraser":
+				pt := c.brushPoint(args[0])
+				c.brushPts = append(c.brushPts, pt)
+				if painter.BrushWork(c.brushOP()) > painter.MaxBrushWork {
+					// Too long for one op, the stroke goes on in another
+					c.brushPts = c.brushPts[:len(c.brushPts)-1]
+					c.replica.Invalidate()
+					c.apply(c.brushOP())
+					c.brushPts = []painter.BrushPoint{c.brushPts[len(c.brushPts)-1], pt}
+				}
+				c.brushMoved = true
+			}
 			return nil
 		})
 
 		keyPressEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 			e := args[0]
+			if !c.canDraw() {
+				return nil
+			}
 			e.Call("preventDefault")
 			key := e.Get("key").String()
-			if key == "Enter" {
-				c.textOff.x = 0
-				c.textOff.y += (c.lineWidth + 10)
+			switch {
+			case key == "Enter":
+				c.text += "\n"
+			case utf8.RuneCountInString(key) == 1:
+				c.text += key
+			default:
+				return nil
 			}
-			if len(key) != 1 {
+			c.sendText()
+			return nil
+		})
+		defer keyPressEvt.Release()
+
+		keyDownEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			e := args[0]
+			if !e.Get("ctrlKey").Bool() && !e.Get("metaKey").Bool() {
+				switch key := e.Get("key").String(); {
+				case key == "Backspace" && c.text != "":
+					e.Call("preventDefault")
+					_, n := utf8.DecodeLastRuneInString(c.text)
+					c.text = c.text[:len(c.text)-n]
+					c.sendText()
+				case c.viewKey(key):
+					e.Call("preventDefault")
+				}
 				return nil
 			}
-			col, _ := colorful.Hex(c.colorHex) // Ignore error
-			op := painter.TextOP{
-				color.RGBA{uint8(col.R * 255), uint8(col.G * 255), uint8(col.B * 255), 255},
-				c.lineWidth + 6,
-				c.lastPos.x + c.textOff.x, c.lastPos.y + c.textOff.y,
-				key,
+			if !c.canDraw() {
+				return nil
 			}
-			c.textOff.x += (c.lineWidth + 10) * 0.6
-
-			c.painter.HandleOP(op)
-			buf, err := json.Marshal(painter.Message{op})
-			if err != nil {
+			switch key := e.Get("key").String(); {
+			case key == "y", key == "Z", key == "z" && e.Get("shiftKey").Bool():
+				c.send(painter.Message{Payload: painter.RedoOP{}})
+			case key == "z":
+				c.send(painter.Message{Payload: painter.UndoOP{}})
+			default:
 				return nil
 			}
-			c.ws.Call("send", string(buf))
+			e.Call("preventDefault")
 			return nil
-
 		})
-		defer keyPressEvt.Release()
-		c.doc.Call("addEventListener", "mousemove", mouseMoveEvt)
-		c.doc.Call("addEventListener", "mousedown", mouseDownEvt)
-		c.doc.Call("addEventListener", "mouseup", mouseUpEvt)
+		defer keyDownEvt.Release()
+		// Pointer events also carry pen pressure
+		c.doc.Call("addEventListener", "pointermove", mouseMoveEvt)
+		c.doc.Call("addEventListener", "pointerdown", mouseDownEvt)
+		c.doc.Call("addEventListener", "pointerup", mouseUpEvt)
 		c.doc.Call("addEventListener", "keypress", keyPressEvt)
+		c.doc.Call("addEventListener", "keydown", keyDownEvt)
+
+		// Pan and zoom
+		pointerCancelEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.gestureUp(args[0])
+			return nil
+		})
+		defer pointerCancelEvt.Release()
+		wheelEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			args[0].Call("preventDefault")
+			c.wheel(args[0])
+			return nil
+		})
+		defer wheelEvt.Release()
+		resizeEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			c.resize()
+			return nil
+		})
+		defer resizeEvt.Release()
+		c.doc.Call("addEventListener", "pointercancel", pointerCancelEvt)
+		// Not passive so the page doesn't zoom
+		c.canvasEl.Call("addEventListener", "wheel", wheelEvt, map[string]interface{}{"passive": false})
+		js.Global().Call("addEventListener", "resize", resizeEvt)
+
+		// Images dropped on the canvas or pasted at the last position
+		dragOverEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			args[0].Call("preventDefault")
+			return nil
+		})
+		defer dragOverEvt.Release()
+		dropEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			e := args[0]
+			e.Call("preventDefault")
+			files := e.Get("dataTransfer").Get("files")
+			if files.Get("length").Int() == 0 {
+				return nil
+			}
+			c.importImage(files.Index(0), c.pointer(e))
+			return nil
+		})
+		defer dropEvt.Release()
+		pasteEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			items := args[0].Get("clipboardData").Get("items")
+			for i := 0; i < items.Get("length").Int(); i++ {
+				item := items.Index(i)
+				if item.Get("kind").String() != "file" {
+					continue
+				}
+				if t := item.Get("type").String(); t != "image/png" && t != "image/jpeg" {
+					continue
+				}
+				args[0].Call("preventDefault")
+				c.importImage(item.Call("getAsFile"), c.lastPos)
+				return nil
+			}
+			return nil
+		})
+		defer pasteEvt.Release()
+		// Admin controls, users are moderated from their entry in the list
+		clearEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			if js.Global().Call("confirm", "Clear the board for everyone?").Bool() {
+				c.send(painter.Message{Payload: painter.ClearOP{}})
+			}
+			return nil
+		})
+		defer clearEvt.Release()
+		moderateEvt := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			data := args[0].Get("target").Get("dataset")
+			if id := data.Get("id"); id.Type() == js.TypeString {
+				c.moderate(data.Get("action").String(), id.String())
+			}
+			return nil
+		})
+		defer moderateEvt.Release()
+		c.doc.Call("getElementById", "clear").Call("addEventListener", "click", clearEvt)
+		c.doc.Call("getElementById", "users").Call("addEventListener", "click", moderateEvt)
+
+		c.canvasEl.Call("addEventListener", "dragover", dragOverEvt)
+		c.canvasEl.Call("addEventListener", "drop", dropEvt)
+		c.doc.Call("addEventListener", "paste", pasteEvt)
 
 		<-c.done
 	}()
 }
+
+// drawAtPointer draws the pen segment to the pointer locally, the whole
+// stroke is sent on mouse up
 func (c *CanvasClient) drawAtPointer(e js.Value) {
 	lastPos := c.lastPos
 
-	c.lastPos.x = e.Get("pageX").Float()
-	c.lastPos.y = e.Get("pageY").Float()
+	c.lastPos = c.pointer(e)
+	c.points = append(c.points, painter.Point{X: c.lastPos.x, Y: c.lastPos.y})
 
-	col, _ := colorful.Hex(c.colorHex) // Ignore error
-	op := painter.LineOP{
-		color.RGBA{uint8(col.R * 255), uint8(col.G * 255), uint8(col.B * 255), 255},
-		c.lineWidth,
-		lastPos.x, lastPos.y,
-		c.lastPos.x, c.lastPos.y,
+	c.replica.View.HandleOP(painter.LineOP{
+		Attr:  c.attr(),
+		Color: c.color(),
+		Width: c.lineWidth,
+		X1:    lastPos.x,
+		Y1:    lastPos.y,
+		X2:    c.lastPos.x,
+		Y2:    c.lastPos.y,
+	})
+}
+
+// cancelStroke drops the stroke being drawn and its preview
+func (c *CanvasClient) cancelStroke() {
+	c.points = nil
+	c.brushPts = nil
+	c.replica.Invalidate()
+}
+
+// sendText sends the whole text block being typed, each version replaces
+// the previous one on the server which answers with the redrawn tiles
+func (c *CanvasClient) sendText() {
+	c.send(painter.Message{Payload: painter.TextOP{
+		Attr:  c.attr(),
+		Color: c.color(),
+		Size:  c.lineWidth + 6,
+		X:     c.lastPos.x,
+		Y:     c.lastPos.y,
+		Text:  c.text,
+		Align: c.align,
+		Edit:  true,
+	}})
+}
+
+// importImage reads a PNG or JPEG file and applies it with its top left
+// corner at at, images larger than the view are scaled down to fit
+func (c *CanvasClient) importImage(file js.Value, at pos) {
+	if size := file.Get("size").Int(); size > painter.MaxImageBytes {
+		c.SetStatus(fmt.Sprintf("image too large: %d bytes", size))
+		return
+	}
+	var loaded js.Func
+	loaded = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		defer loaded.Release()
+		arr := js.Global().Get("Uint8Array").New(args[0])
+		data := make([]byte, arr.Get("length").Int())
+		js.CopyBytesToGo(data, arr)
+
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			c.SetStatus("invalid image")
+			return nil
+		}
+		if cfg.Width > painter.MaxImageSize || cfg.Height > painter.MaxImageSize {
+			c.SetStatus(fmt.Sprintf("image too large: %dx%d", cfg.Width, cfg.Height))
+			return nil
+		}
+		scale := math.Min(1, math.Min(
+			c.width/c.zoom/float64(cfg.Width),
+			c.height/c.zoom/float64(cfg.Height),
+		))
+		c.apply(painter.ImageOP{
+			Attr:  c.attr(),
+			Data:  data,
+			X:     at.x,
+			Y:     at.y,
+			Scale: scale,
+		})
+		return nil
+	})
+	file.Call("arrayBuffer").Call("then", loaded)
+}
+
+// updateView subscribes to the chunks shown if they changed, chunks no
+// longer shown are dropped and the new ones come from the server
+func (c *CanvasClient) updateView() {
+	view := painter.ChunksIn(c.visible())
+	if view == c.view {
+		return
 	}
-	c.painter.HandleOP(op)
+	c.replica.Retain(view.Intersect(c.view))
+	c.view = view
+	c.send(painter.Message{Payload: painter.ViewOP{
+		X:      view.Min.X,
+		Y:      view.Min.Y,
+		Width:  view.Dx(),
+		Height: view.Dy(),
+	}})
+}
+
+// apply draws op locally and sends it, it stays pending until the server
+// echoes it back
+func (c *CanvasClient) apply(op interface{}) {
+	if !c.canDraw() {
+		return
+	}
+	c.send(c.replica.Local(op))
+}
 
-	buf, err := json.Marshal(painter.Message{op})
+// canDraw reports whether our role lets us draw, the server refuses our
+// ops otherwise
+func (c *CanvasClient) canDraw() bool {
+	return c.role >= painter.RoleDraw
+}
+
+// brushOP returns the brush stroke being drawn
+func (c *CanvasClient) brushOP() painter.BrushOP {
+	return painter.BrushOP{
+		Attr:  c.attr(),
+		Color: c.color(),
+		Brush: painter.Brush{
+			Size:     c.lineWidth,
+			Opacity:  c.opacity,
+			Hardness: c.hardness,
+			Texture:  c.texture,
+			Eraser:   c.tool == "eraser",
+		},
+		Points: c.brushPts,
+	}
+}
+
+// brushPoint returns the pointer position of e with the pen pressure, other
+// pointers press fully
+func (c *CanvasClient) brushPoint(e js.Value) painter.BrushPoint {
+	pressure := 1.0
+	if e.Get("pointerType").String() == "pen" {
+		pressure = e.Get("pressure").Float()
+	}
+	at := c.pointer(e)
+	return painter.BrushPoint{
+		X:        at.x,
+		Y:        at.y,
+		Pressure: pressure,
+	}
+}
+
+// attr returns the attributes of the ops of the current stroke
+func (c *CanvasClient) attr() painter.Attr {
+	return painter.Attr{Stroke: c.stroke, Layer: c.layer}
+}
+
+// color returns the selected color
+func (c *CanvasClient) color() color.RGBA {
+	col, _ := colorful.Hex(c.colorHex) // Ignore error
+	return color.RGBA{uint8(col.R * 255), uint8(col.G * 255), uint8(col.B * 255), 255}
+}
+
+// send encodes m with the negotiated codec and writes it to the socket
+func (c *CanvasClient) send(m painter.Message) {
+	buf, err := c.codec.Marshal(m)
 	if err != nil {
 		return
 	}
-	c.ws.Call("send", string(buf))
+	if c.codec != painter.CodecBinary {
+		c.ws.Call("send", string(buf))
+		return
+	}
+	arr := js.Global().Get("Uint8Array").New(len(buf))
+	js.CopyBytesToJS(arr, buf)
+	c.ws.Call("send", arr)
+}
+
+// currentLayer returns the selected layer and its position
+func (c *CanvasClient) currentLayer() (painter.LayerInfo, int) {
+	i := c.layerIndex(c.layer)
+	if i == -1 {
+		i = 0
+	}
+	if i >= len(c.layers) {
+		return painter.LayerInfo{}, 0
+	}
+	return c.layers[i], i
+}
 
+func (c *CanvasClient) layerIndex(name string) int {
+	for i, l := range c.layers {
+		if l.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// updateLayer sends the selected layer modified by fn
+func (c *CanvasClient) updateLayer(fn func(l *painter.LayerInfo)) {
+	info, at := c.currentLayer()
+	if info.Name == "" {
+		return
+	}
+	fn(&info)
+	c.apply(painter.LayerOP{LayerInfo: info, At: at})
+}
+
+// updateLayers refreshes the layer controls if the layers changed
+func (c *CanvasClient) updateLayers() {
+	layers := c.replica.View.Layers()
+	if len(layers) == len(c.layers) {
+		same := true
+		for i := range layers {
+			same = same && layers[i] == c.layers[i]
+		}
+		if same {
+			return
+		}
+	}
+	c.layers = layers
+	if c.layerIndex(c.layer) == -1 {
+		c.layer = ""
+	}
+	info, _ := c.currentLayer()
+	sel := c.doc.Call("getElementById", "layer")
+	sel.Set("innerHTML", "")
+	// Top layer first
+	for i := len(layers) - 1; i >= 0; i-- {
+		opt := c.doc.Call("createElement", "option")
+		opt.Set("value", layers[i].Name)
+		opt.Set("textContent", layers[i].Name)
+		sel.Call("appendChild", opt)
+	}
+	sel.Set("value", info.Name)
+	c.showLayer()
 }
+
+// showLayer sets the layer controls to the selected layer
+func (c *CanvasClient) showLayer() {
+	info, _ := c.currentLayer()
+	c.doc.Call("getElementById", "layer-hidden").Set("checked", info.Hidden)
+	c.doc.Call("getElementById", "layer-opacity").Set("value", int(info.Opacity))
+	c.doc.Call("getElementById", "layer-blend").Set("value", strconv.Itoa(int(info.Blend)))
+}
+
 func (c *CanvasClient) SetStatus(txt string) {
 	c.doc.Call("getElementById", "status").Set("innerHTML", txt)
 }
-func (c *CanvasClient) draw() {
+
+// upload copies the region d of the view into the buffer canvas
+func (c *CanvasClient) upload(d image.Rectangle) {
+	img, im, arr := c.frame, c.im, c.byteArray
+	if d != c.frame.Rect {
+		img = image.NewRGBA(d)
+		im = c.bufferCtx.Call("createImageData", d.Dx(), d.Dy())
+		arr = js.Global().Get("Uint8Array").New(len(img.Pix))
+	}
 	// golang buffer
 	// Needs to be a Uint8Array while image data have Uint8ClampedArray
-	js.CopyBytesToJS(c.byteArray, c.painter.ImageData())
-	c.im.Get("data").Call("set", c.byteArray)
-	c.ctx.Call("putImageData", c.im, 0, 0)
+	c.replica.View.ReadRegion(img)
+	js.CopyBytesToJS(arr, img.Pix)
+	im.Get("data").Call("set", arr)
+	c.bufferCtx.Call("putImageData", im, d.Min.X-c.frame.Rect.Min.X, d.Min.Y-c.frame.Rect.Min.Y)
+}
+
+func (c *CanvasClient) draw() {
+	if c.frame == nil {
+		// Not initialized yet
+		return
+	}
+	if c.brushMoved {
+		// The brush preview is redrawn whole so it looks like the result
+		c.replica.Invalidate()
+		c.brushMoved = false
+	}
+	if c.replica.Sync() {
+		// Strokes in progress are drawn directly on the view
+		if len(c.points) > 1 {
+			c.replica.View.HandleOP(painter.PolylineOP{
+				Attr:   c.attr(),
+				Color:  c.color(),
+				Width:  c.lineWidth,
+				Points: c.points,
+			})
+		}
+		if len(c.brushPts) > 0 {
+			c.replica.View.HandleOP(c.brushOP())
+		}
+	}
+	c.updateLayers()
+	c.flushCursor()
+	// Only the visible region is read, the buffers follow its size
+	r := c.visible()
+	if r.Size() != c.frame.Rect.Size() {
+		c.frame = image.NewRGBA(r)
+		c.buffer.Set("width", r.Dx())
+		c.buffer.Set("height", r.Dy())
+		c.im = c.bufferCtx.Call("createImageData", r.Dx(), r.Dy())
+		c.byteArray = js.Global().Get("Uint8Array").New(len(c.frame.Pix))
+		c.moved = true
+	}
+	c.frame.Rect = r
+	if c.peersMoved || c.moved {
+		c.drawCursors()
+		c.peersMoved = false
+	}
+	dirty := c.replica.View.Dirty()
+	if c.moved {
+		dirty = []image.Rectangle{r}
+	}
+	changed := false
+	for _, d := range dirty {
+		if d = d.Intersect(r); !d.Empty() {
+			c.upload(d)
+			changed = true
+		}
+	}
+	if !changed && !c.moved {
+		// Nothing to redraw
+		return
+	}
+	c.moved = false
+
+	// Pixels stay sharp when zoomed in
+	c.ctx.Set("imageSmoothingEnabled", c.zoom < 1)
+	c.ctx.Call("clearRect", 0, 0, c.width, c.height)
+	c.ctx.Call("drawImage", c.buffer,
+		(float64(r.Min.X)-c.pan.x)*c.zoom, (float64(r.Min.Y)-c.pan.y)*c.zoom,
+		float64(r.Dx())*c.zoom, float64(r.Dy())*c.zoom,
+	)
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"syscall/js"
+	"time"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+// cursorEvery is the shortest interval between the cursor positions sent,
+// the server relays them at the same rate
+const cursorEvery = 50 * time.Millisecond
+
+// peer is a user in the room
+type peer struct {
+	name  string
+	color color.RGBA
+	// at is the canvas position of its cursor, once it sent one
+	at     pos
+	hasPos bool
+}
+
+// presence handles the presence and cursor messages, it reports whether m
+// was one of those
+func (c *CanvasClient) presence(m painter.Message) bool {
+	switch o := m.Payload.(type) {
+	case painter.PresenceOP:
+		if o.Self {
+			// The server introduces everyone on join
+			c.peers = map[string]*peer{}
+			c.self = o.Author
+			c.setRole(o.Role)
+		}
+		if o.Left {
+			delete(c.peers, o.Author)
+		} else {
+			c.peers[o.Author] = &peer{name: o.Name, color: o.Color}
+		}
+		c.updateUsers()
+	case painter.CursorOP:
+		p, ok := c.peers[o.Author]
+		if !ok {
+			return true
+		}
+		p.at, p.hasPos = pos{o.X, o.Y}, true
+	default:
+		return false
+	}
+	c.peersMoved = true
+	return true
+}
+
+// moveCursor sets the canvas position of our cursor, it is sent on the
+// next frame cursorEvery allows
+func (c *CanvasClient) moveCursor(at pos) {
+	c.cursorAt = at
+	c.cursorMoved = true
+}
+
+// flushCursor sends our cursor position if it moved and it is time to
+func (c *CanvasClient) flushCursor() {
+	if !c.cursorMoved || time.Since(c.cursorSent) < cursorEvery {
+		return
+	}
+	c.send(painter.Message{Payload: painter.CursorOP{X: c.cursorAt.x, Y: c.cursorAt.y}})
+	c.cursorSent = time.Now()
+	c.cursorMoved = false
+}
+
+// drawCursors draws the cursors of the other users with their names on the
+// overlay canvas
+func (c *CanvasClient) drawCursors() {
+	ctx := c.overlayCtx
+	ctx.Call("clearRect", 0, 0, c.width, c.height)
+	ctx.Set("font", "12px sans-serif")
+	ctx.Set("textBaseline", "middle")
+	for id, p := range c.peers {
+		if id == c.self || !p.hasPos {
+			continue
+		}
+		x := (p.at.x - c.pan.x) * c.zoom
+		y := (p.at.y - c.pan.y) * c.zoom
+		if x < -200 || y < -20 || x > c.width || y > c.height {
+			continue
+		}
+		col := cssColor(p.color)
+		// Arrow pointing at x, y
+		ctx.Set("fillStyle", col)
+		ctx.Call("beginPath")
+		ctx.Call("moveTo", x, y)
+		ctx.Call("lineTo", x, y+16)
+		ctx.Call("lineTo", x+4, y+12)
+		ctx.Call("lineTo", x+11, y+11)
+		ctx.Call("closePath")
+		ctx.Call("fill")
+		// Name tag
+		w := ctx.Call("measureText", p.name).Get("width").Float()
+		ctx.Call("fillRect", x+10, y+14, w+8, 16)
+		ctx.Set("fillStyle", "#fff")
+		ctx.Call("fillText", p.name, x+14, y+22)
+	}
+}
+
+// updateUsers lists the users in the room, ours first
+func (c *CanvasClient) updateUsers() {
+	ids := []string{}
+	for id := range c.peers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if (ids[i] == c.self) != (ids[j] == c.self) {
+			return ids[i] == c.self
+		}
+		return c.peers[ids[i]].name < c.peers[ids[j]].name
+	})
+	list := c.doc.Call("getElementById", "users")
+	list.Set("innerHTML", "")
+	for _, id := range ids {
+		p := c.peers[id]
+		el := c.doc.Call("createElement", "div")
+		// textContent so names can't inject markup
+		name := p.name
+		if id == c.self {
+			name += " (you)"
+		}
+		el.Set("textContent", name)
+		el.Get("style").Set("color", cssColor(p.color))
+		if c.role >= painter.RoleAdmin && id != c.self {
+			for _, action := range []string{"erase", "kick", "ban"} {
+				b := c.doc.Call("createElement", "button")
+				b.Set("textContent", action)
+				b.Get("dataset").Set("action", action)
+				b.Get("dataset").Set("id", id)
+				el.Call("appendChild", b)
+			}
+		}
+		list.Call("appendChild", el)
+	}
+}
+
+// moderate sends the admin action picked for the user with id, erase asks
+// how far back to go
+func (c *CanvasClient) moderate(action, id string) {
+	p, ok := c.peers[id]
+	if !ok {
+		return
+	}
+	var op interface{}
+	switch action {
+	case "erase":
+		v := js.Global().Call("prompt", "Erase what "+p.name+" drew in the last minutes:", "10")
+		min, err := strconv.ParseFloat(v.String(), 64)
+		if v.Type() != js.TypeString || err != nil {
+			return
+		}
+		since := time.Now().Add(-time.Duration(min * float64(time.Minute)))
+		op = painter.EraseOP{Target: id, Since: since.Unix()}
+	case "kick":
+		op = painter.KickOP{Target: id}
+	case "ban":
+		if !js.Global().Call("confirm", "Ban "+p.name+"?").Bool() {
+			return
+		}
+		op = painter.BanOP{Target: id}
+	default:
+		return
+	}
+	c.send(painter.Message{Payload: op})
+}
+
+// setRole shows the controls our role allows
+func (c *CanvasClient) setRole(role uint8) {
+	c.role = role
+	display := "none"
+	if role >= painter.RoleAdmin {
+		display = "block"
+		if !c.hasClearTool {
+			// Clearing an area is a tool
+			opt := c.doc.Call("createElement", "option")
+			opt.Set("value", "clear")
+			opt.Set("textContent", "clear area")
+			c.doc.Call("getElementById", "tool").Call("appendChild", opt)
+			c.hasClearTool = true
+		}
+	}
+	c.doc.Call("getElementById", "admin").Get("style").Set("display", display)
+	// Only admins delete or hide layers, a transparent layer is hidden
+	admin := role >= painter.RoleAdmin
+	c.doc.Call("getElementById", "layer-del").Set("disabled", !admin)
+	c.doc.Call("getElementById", "layer-hidden").Set("disabled", !admin)
+	minOpacity := 1
+	if admin {
+		minOpacity = 0
+	}
+	c.doc.Call("getElementById", "layer-opacity").Set("min", minOpacity)
+	if role < painter.RoleDraw {
+		c.SetStatus("view only")
+	}
+}
+
+func cssColor(c color.RGBA) string {
+	return fmt.Sprintf("rgb(%d,%d,%d)", c.R, c.G, c.B)
+}
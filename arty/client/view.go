@@ -0,0 +1,201 @@
+package main
+
+import (
+	"image"
+	"math"
+	"syscall/js"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+// View limits, zooming out is also limited by the chunks a view may have
+const (
+	minZoom = 0.1
+	maxZoom = 16
+	// zoomStep is the zoom factor of a key press or a wheel notch
+	zoomStep = 1.25
+	// panStep is the screen distance an arrow key pans
+	panStep = 64
+)
+
+// gesture tracks the pointers panning or zooming the view
+type gesture struct {
+	// touches down by pointer id, in screen coordinates
+	touches map[int]pos
+	// panning with the middle button, last is the previous position
+	panning bool
+	last    pos
+}
+
+// toCanvas maps a screen position on the canvas element to canvas
+// coordinates
+func (c *CanvasClient) toCanvas(x, y float64) pos {
+	return pos{c.pan.x + x/c.zoom, c.pan.y + y/c.zoom}
+}
+
+// pointer returns the canvas position of a pointer event
+func (c *CanvasClient) pointer(e js.Value) pos {
+	return c.toCanvas(e.Get("pageX").Float(), e.Get("pageY").Float())
+}
+
+// visible returns the canvas region shown, rounded out to whole pixels
+func (c *CanvasClient) visible() image.Rectangle {
+	return c.visibleAt(c.pan, c.zoom)
+}
+
+func (c *CanvasClient) visibleAt(pan pos, zoom float64) image.Rectangle {
+	return image.Rect(
+		int(math.Floor(pan.x)), int(math.Floor(pan.y)),
+		int(math.Ceil(pan.x+c.width/zoom)), int(math.Ceil(pan.y+c.height/zoom)),
+	)
+}
+
+// setView moves the view to pan and zoom, it is left as is if the server
+// wouldn't send that many chunks
+func (c *CanvasClient) setView(pan pos, zoom float64) {
+	zoom = math.Max(minZoom, math.Min(zoom, maxZoom))
+	cr := painter.ChunksIn(c.visibleAt(pan, zoom))
+	if cr.Dx()*cr.Dy() > painter.MaxViewChunks {
+		return
+	}
+	c.pan, c.zoom = pan, zoom
+	c.moved = true
+	c.updateView()
+}
+
+// zoomAt zooms keeping the canvas point under the screen position x, y in
+// place
+func (c *CanvasClient) zoomAt(zoom, x, y float64) {
+	zoom = math.Max(minZoom, math.Min(zoom, maxZoom))
+	at := c.toCanvas(x, y)
+	c.setView(pos{at.x - x/zoom, at.y - y/zoom}, zoom)
+}
+
+// panBy moves the view by a screen distance
+func (c *CanvasClient) panBy(dx, dy float64) {
+	c.setView(pos{c.pan.x + dx/c.zoom, c.pan.y + dy/c.zoom}, c.zoom)
+}
+
+// resize fits the canvas element to the window
+func (c *CanvasClient) resize() {
+	c.width = js.Global().Get("innerWidth").Float()
+	c.height = js.Global().Get("innerHeight").Float()
+	c.canvasEl.Set("width", c.width)
+	c.canvasEl.Set("height", c.height)
+	c.overlay.Set("width", c.width)
+	c.overlay.Set("height", c.height)
+	c.moved = true
+	if c.frame != nil {
+		c.updateView()
+	}
+}
+
+// viewKey pans with the arrow keys, zooms with page up and down and resets
+// the view with home, it reports whether key was one of those
+func (c *CanvasClient) viewKey(key string) bool {
+	switch key {
+	case "ArrowLeft":
+		c.panBy(-panStep, 0)
+	case "ArrowRight":
+		c.panBy(panStep, 0)
+	case "ArrowUp":
+		c.panBy(0, -panStep)
+	case "ArrowDown":
+		c.panBy(0, panStep)
+	case "PageUp":
+		c.zoomAt(c.zoom*zoomStep, c.width/2, c.height/2)
+	case "PageDown":
+		c.zoomAt(c.zoom/zoomStep, c.width/2, c.height/2)
+	case "Home":
+		c.setView(pos{}, 1)
+	default:
+		return false
+	}
+	return true
+}
+
+// wheel zooms around the pointer with ctrl, which is also how trackpads
+// report a pinch, and pans otherwise
+func (c *CanvasClient) wheel(e js.Value) {
+	dx, dy := e.Get("deltaX").Float(), e.Get("deltaY").Float()
+	if e.Get("deltaMode").Int() == 1 { // lines
+		dx, dy = dx*16, dy*16
+	}
+	if e.Get("ctrlKey").Bool() {
+		x, y := e.Get("pageX").Float(), e.Get("pageY").Float()
+		c.zoomAt(c.zoom*math.Pow(zoomStep, -dy/100), x, y)
+		return
+	}
+	c.panBy(dx, dy)
+}
+
+// gestureDown starts panning with the middle button or zooming with a
+// second touch, it reports whether the event belongs to a gesture
+func (c *CanvasClient) gestureDown(e js.Value) bool {
+	g := &c.gesture
+	p := pos{e.Get("pageX").Float(), e.Get("pageY").Float()}
+	if e.Get("buttons").Int() == 4 {
+		g.panning, g.last = true, p
+		return true
+	}
+	if e.Get("pointerType").String() != "touch" {
+		return false
+	}
+	if g.touches == nil {
+		g.touches = map[int]pos{}
+	}
+	g.touches[e.Get("pointerId").Int()] = p
+	return len(g.touches) > 1
+}
+
+// gestureMove pans and zooms following the gesture pointers, with two
+// touches the view follows their middle point and distance
+func (c *CanvasClient) gestureMove(e js.Value) bool {
+	g := &c.gesture
+	p := pos{e.Get("pageX").Float(), e.Get("pageY").Float()}
+	if g.panning {
+		c.panBy(g.last.x-p.x, g.last.y-p.y)
+		g.last = p
+		return true
+	}
+	id := e.Get("pointerId").Int()
+	prev, ok := g.touches[id]
+	if !ok {
+		return false
+	}
+	g.touches[id] = p
+	if len(g.touches) != 2 {
+		return false
+	}
+	var other pos
+	for k, t := range g.touches {
+		if k != id {
+			other = t
+		}
+	}
+	d0 := math.Hypot(prev.x-other.x, prev.y-other.y)
+	d1 := math.Hypot(p.x-other.x, p.y-other.y)
+	m0 := pos{(prev.x + other.x) / 2, (prev.y + other.y) / 2}
+	m1 := pos{(p.x + other.x) / 2, (p.y + other.y) / 2}
+	c.panBy(m0.x-m1.x, m0.y-m1.y)
+	if d0 > 0 {
+		c.zoomAt(c.zoom*d1/d0, m1.x, m1.y)
+	}
+	return true
+}
+
+// gestureUp ends a gesture, it reports whether the event belonged to one
+func (c *CanvasClient) gestureUp(e js.Value) bool {
+	g := &c.gesture
+	if g.panning {
+		g.panning = false
+		return true
+	}
+	id := e.Get("pointerId").Int()
+	if _, ok := g.touches[id]; !ok {
+		return false
+	}
+	n := len(g.touches)
+	delete(g.touches, id)
+	return n > 1
+}
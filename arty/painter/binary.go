@@ -0,0 +1,284 @@
+package painter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Binary layout of a Message:
+//
+//	uvarint op code
+//	uvarint Seq
+//	uvarint Ref
+//	payload fields in declaration order
+//
+// Fields are encoded by kind: uint8 as a raw byte (color.RGBA packs into 4
+// bytes), other integers as varints, floats as little endian float64,
+// strings and []byte as uvarint length + data, slices as uvarint count +
+// elements and structs field by field.
+
+var errShortBuffer = errors.New("binary message too short")
+
+func (m Message) MarshalBinary() ([]byte, error) {
+	op := opCode(m.Payload)
+	if op == 0 {
+		return nil, errUnknownOP
+	}
+	w := &binWriter{}
+	w.uvarint(uint64(op))
+	w.uvarint(m.Seq)
+	w.uvarint(uint64(m.Ref))
+	if err := w.value(reflect.ValueOf(m.Payload)); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (m *Message) UnmarshalBinary(data []byte) error {
+	r := &binReader{buf: data}
+	op, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	payload, err := opPayload(uint(op))
+	if err != nil {
+		return err
+	}
+	seq, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	ref, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(payload).Elem()
+	if err := r.value(v); err != nil {
+		return err
+	}
+	m.Seq = seq
+	m.Ref = uint32(ref)
+	m.Payload = v.Interface()
+	return nil
+}
+
+type binWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *binWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binWriter) varint(v int64) {
+	n := binary.PutVarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binWriter) float64(v float64) {
+	binary.LittleEndian.PutUint64(w.tmp[:8], math.Float64bits(v))
+	w.buf = append(w.buf, w.tmp[:8]...)
+}
+
+func (w *binWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *binWriter) value(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			w.buf = append(w.buf, 1)
+		} else {
+			w.buf = append(w.buf, 0)
+		}
+	case reflect.Uint8:
+		w.buf = append(w.buf, uint8(v.Uint()))
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		w.uvarint(v.Uint())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.varint(v.Int())
+	case reflect.Float32, reflect.Float64:
+		w.float64(v.Float())
+	case reflect.String:
+		w.bytes([]byte(v.String()))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.bytes(v.Bytes())
+			return nil
+		}
+		w.uvarint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := w.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := w.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" { // unexported
+				continue
+			}
+			if err := w.value(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("binary: unsupported kind %s", v.Kind())
+	}
+	return nil
+}
+
+type binReader struct {
+	buf []byte
+}
+
+func (r *binReader) byte() (byte, error) {
+	if len(r.buf) < 1 {
+		return 0, errShortBuffer
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b, nil
+}
+
+func (r *binReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errShortBuffer
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *binReader) varint() (int64, error) {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		return 0, errShortBuffer
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *binReader) float64() (float64, error) {
+	if len(r.buf) < 8 {
+		return 0, errShortBuffer
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.buf))
+	r.buf = r.buf[8:]
+	return v, nil
+}
+
+// length reads a length prefix that must fit in the remaining buffer
+func (r *binReader) length() (int, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(r.buf)) {
+		return 0, errShortBuffer
+	}
+	return int(n), nil
+}
+
+func (r *binReader) bytes() ([]byte, error) {
+	n, err := r.length()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+func (r *binReader) value(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b != 0)
+	case reflect.Uint8:
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		v.SetUint(uint64(b))
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := r.varint()
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := r.float64()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(b)
+			return nil
+		}
+		n, err := r.length()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			if err := r.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := r.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			if err := r.value(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("binary: unsupported kind %s", v.Kind())
+	}
+	return nil
+}
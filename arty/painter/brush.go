@@ -0,0 +1,220 @@
+package painter
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Brush describes how a BrushOP is painted, a stroke is a trail of dabs of
+// Size at full pressure spaced by Spacing times their size, Hardness is the
+// fraction of the dab radius painted fully before it fades out and Texture
+// names a stamp in the painter Textures, empty for a round dab. Dabs don't
+// add up, a stroke is painted at once with Opacity, with Eraser it removes
+// paint instead. Strokes are bounded by MaxBrushWork, long ones are sent as
+// several ops.
+type Brush struct {
+	Size     float64
+	Opacity  uint8
+	Hardness float64
+	Spacing  float64
+	Texture  string
+	Eraser   bool
+}
+
+// BrushPoint is a point of a BrushOP, Pressure from 0 to 1 scales the dab
+type BrushPoint struct {
+	X, Y     float64
+	Pressure float64
+}
+
+// defaultSpacing is used for brushes without Spacing
+const defaultSpacing = 0.1
+
+// MinBrushSpacing is the smallest Spacing of a brush other than 0
+const MinBrushSpacing = 0.05
+
+// MaxBrushWork bounds the pixels a BrushOP paints, see BrushWork
+const MaxBrushWork = 1 << 25
+
+// textureSize is the edge of the builtin textures
+const textureSize = 64
+
+// Textures are grayscale stamps for brushes by name, the alpha is used
+type Textures map[string]*image.Alpha
+
+// NewTextures returns the builtin textures "square", "noise" and "hatch"
+func NewTextures() Textures {
+	r := image.Rect(0, 0, textureSize, textureSize)
+	square := image.NewAlpha(r)
+	noise := image.NewAlpha(r)
+	hatch := image.NewAlpha(r)
+	for y := 0; y < textureSize; y++ {
+		for x := 0; x < textureSize; x++ {
+			square.SetAlpha(x, y, color.Alpha{255})
+			noise.SetAlpha(x, y, color.Alpha{uint8(hash2(x, y) >> 24)})
+			if (x+y)%8 < 3 {
+				hatch.SetAlpha(x, y, color.Alpha{255})
+			}
+		}
+	}
+	return Textures{"square": square, "noise": noise, "hatch": hatch}
+}
+
+// hash2 is a small integer hash so noise is the same everywhere
+func hash2(x, y int) uint32 {
+	h := uint32(x)*374761393 + uint32(y)*668265263
+	h = (h ^ (h >> 13)) * 1274126177
+	return h ^ (h >> 16)
+}
+
+// Brush paints op on its layer, see Brush
+func (p *BufPainter) Brush(op BrushOP) error {
+	l := p.layer(op.Layer)
+	if l == nil {
+		return errUnknownLayer
+	}
+	var tex *image.Alpha
+	if op.Brush.Texture != "" {
+		var ok bool
+		if tex, ok = p.Textures[op.Brush.Texture]; !ok {
+			return fmt.Errorf("unknown texture %q", op.Brush.Texture)
+		}
+	}
+	r := p.bounds(op)
+	if r.Empty() || op.Brush.Size <= 0 {
+		return nil
+	}
+	// mask holds the coverage of the stroke, dabs keep the max
+	mask := make([]float64, r.Dx()*r.Dy())
+	dab := func(x, y, pressure float64) {
+		rad := op.Brush.Size * pressure / 2
+		if rad <= 0 {
+			return
+		}
+		hard := math.Max(0, math.Min(op.Brush.Hardness, 1))
+		dr := rectF(x-rad, y-rad, x+rad, y+rad).Intersect(r)
+		for py := dr.Min.Y; py < dr.Max.Y; py++ {
+			for px := dr.Min.X; px < dr.Max.X; px++ {
+				// distance from the pixel center relative to the radius
+				dx := (float64(px) + 0.5 - x) / rad
+				dy := (float64(py) + 0.5 - y) / rad
+				a := 1.0
+				if tex != nil {
+					tb := tex.Bounds()
+					tx := tb.Min.X + int((dx+1)/2*float64(tb.Dx()))
+					ty := tb.Min.Y + int((dy+1)/2*float64(tb.Dy()))
+					a = float64(tex.AlphaAt(tx, ty).A) / 255
+				} else {
+					d := math.Hypot(dx, dy)
+					switch {
+					case d >= 1:
+						a = 0
+					case d > hard:
+						a = (1 - d) / (1 - hard)
+					}
+				}
+				i := (py-r.Min.Y)*r.Dx() + px - r.Min.X
+				mask[i] = math.Max(mask[i], a)
+			}
+		}
+	}
+
+	pts := op.Points
+	dab(pts[0].X, pts[0].Y, pts[0].Pressure)
+	// walked is the path length up to the current segment, next is where
+	// the next dab goes
+	walked, next := 0.0, op.Brush.step(pts[0].Pressure)
+	for i := 1; i < len(pts); i++ {
+		a, b := pts[i-1], pts[i]
+		seg := math.Hypot(b.X-a.X, b.Y-a.Y)
+		for seg > 0 && next <= walked+seg {
+			t := (next - walked) / seg
+			pressure := a.Pressure + (b.Pressure-a.Pressure)*t
+			dab(a.X+(b.X-a.X)*t, a.Y+(b.Y-a.Y)*t, pressure)
+			next += op.Brush.step(pressure)
+		}
+		walked += seg
+	}
+
+	opacity := float64(op.Brush.Opacity) / 255
+	if op.Brush.Eraser {
+		p.erase(l, r, mask, opacity)
+		return nil
+	}
+	// The stroke color with the coverage as alpha, premultiplied
+	img := image.NewRGBA(r)
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			a := mask[(py-r.Min.Y)*r.Dx()+px-r.Min.X] * opacity
+			if a == 0 {
+				continue
+			}
+			sa := float64(op.Color.A) / 255 * a
+			i := img.PixOffset(px, py)
+			img.Pix[i+0] = uint8(float64(op.Color.R)*sa + 0.5)
+			img.Pix[i+1] = uint8(float64(op.Color.G)*sa + 0.5)
+			img.Pix[i+2] = uint8(float64(op.Color.B)*sa + 0.5)
+			img.Pix[i+3] = uint8(255*sa + 0.5)
+		}
+	}
+	l.chunks.write(img, r, draw.Over)
+	return nil
+}
+
+// step is the distance from a dab at pressure to the next one, light dabs
+// are at most 4 times closer than full ones
+func (b Brush) step(pressure float64) float64 {
+	spacing := b.Spacing
+	if spacing <= 0 {
+		spacing = defaultSpacing
+	}
+	return b.Size * spacing * math.Max(pressure, 0.25)
+}
+
+// BrushWork returns a bound of the pixels op paints, the dabs its path
+// fits at the closest step each counted as a full size square
+func BrushWork(op BrushOP) float64 {
+	step := op.Brush.step(0)
+	if step <= 0 {
+		return 0
+	}
+	dabs := 1.0
+	for i := 1; i < len(op.Points); i++ {
+		a, b := op.Points[i-1], op.Points[i]
+		dabs += math.Hypot(b.X-a.X, b.Y-a.Y) / step
+	}
+	size := math.Max(op.Brush.Size, 1)
+	return dabs * size * size
+}
+
+// erase removes paint from the chunks of l within r by the mask coverage
+func (p *BufPainter) erase(l *layer, r image.Rectangle, mask []float64, opacity float64) {
+	cr := ChunksIn(r)
+	for y := cr.Min.Y; y < cr.Max.Y; y++ {
+		for x := cr.Min.X; x < cr.Max.X; x++ {
+			pos := ChunkPos{x, y}
+			img, ok := l.chunks[pos]
+			if !ok {
+				continue
+			}
+			pr := pos.Rect().Intersect(r)
+			for py := pr.Min.Y; py < pr.Max.Y; py++ {
+				for px := pr.Min.X; px < pr.Max.X; px++ {
+					a := mask[(py-r.Min.Y)*r.Dx()+px-r.Min.X] * opacity
+					if a == 0 {
+						continue
+					}
+					i := img.PixOffset(px, py)
+					pix := img.Pix[i : i+4]
+					for c := range pix {
+						pix[c] = uint8(float64(pix[c])*(1-a) + 0.5)
+					}
+				}
+			}
+			l.chunks.prune(pos)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package painter
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestValidateBrushWork(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	zigzag := []BrushPoint{{0, 0, 1}, {3800, 3800, 1}, {0, 0, 1}, {3800, 3800, 1}}
+	tests := []struct {
+		name  string
+		op    BrushOP
+		valid bool
+	}{
+		{"stroke", BrushOP{Color: red, Brush: Brush{Size: 20}, Points: []BrushPoint{{0, 0, 1}, {500, 300, 0.5}}}, true},
+		{"dot", BrushOP{Color: red, Brush: Brush{Size: 200}, Points: []BrushPoint{{0, 0, 0}}}, true},
+		{"big stroke", BrushOP{Color: red, Brush: Brush{Size: 200}, Points: []BrushPoint{{0, 0, 1}, {2000, 0, 1}}}, true},
+		{"tiny spacing", BrushOP{Color: red, Brush: Brush{Size: 200, Spacing: 0.0001}, Points: zigzag[:2]}, false},
+		{"long zigzag", BrushOP{Color: red, Brush: Brush{Size: 200}, Points: zigzag}, false},
+	}
+	for _, tt := range tests {
+		err := Validate(tt.op)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: work %g, error %v", tt.name, BrushWork(tt.op), err)
+		}
+	}
+}
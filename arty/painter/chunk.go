@@ -0,0 +1,244 @@
+package painter
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"sort"
+
+	"github.com/llgcode/draw2d"
+	"github.com/llgcode/draw2d/draw2dimg"
+)
+
+// ChunkSize is the edge of the square chunks canvases are stored in
+const ChunkSize = 256
+
+// MaxOpSize bounds the width and height of the area a single op draws
+const MaxOpSize = 4096
+
+var errOpTooLarge = errors.New("operation too large")
+
+// ChunkPos addresses a chunk, chunk 0, 0 starts at the canvas origin
+type ChunkPos struct {
+	X, Y int
+}
+
+// Rect returns the canvas area of the chunk
+func (c ChunkPos) Rect() image.Rectangle {
+	x, y := c.X*ChunkSize, c.Y*ChunkSize
+	return image.Rect(x, y, x+ChunkSize, y+ChunkSize)
+}
+
+// chunkAt returns the chunk containing the canvas point x, y
+func chunkAt(x, y int) ChunkPos {
+	return ChunkPos{floorDiv(x, ChunkSize), floorDiv(y, ChunkSize)}
+}
+
+// ChunksIn returns the range of chunks covering r, in chunk coordinates
+func ChunksIn(r image.Rectangle) image.Rectangle {
+	if r.Empty() {
+		return image.Rectangle{}
+	}
+	return image.Rect(
+		floorDiv(r.Min.X, ChunkSize), floorDiv(r.Min.Y, ChunkSize),
+		floorDiv(r.Max.X-1, ChunkSize)+1, floorDiv(r.Max.Y-1, ChunkSize)+1,
+	)
+}
+
+// ChunkRect returns the canvas area of the cr chunk range
+func ChunkRect(cr image.Rectangle) image.Rectangle {
+	return image.Rect(
+		cr.Min.X*ChunkSize, cr.Min.Y*ChunkSize,
+		cr.Max.X*ChunkSize, cr.Max.Y*ChunkSize,
+	)
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// chunks is a sparse image, missing chunks are transparent and chunk
+// images use canvas coordinates
+type chunks map[ChunkPos]*image.RGBA
+
+// positions returns the chunks within the cr chunk range, top to bottom
+// and left to right
+func (c chunks) positions(cr image.Rectangle) []ChunkPos {
+	ret := []ChunkPos{}
+	for pos := range c {
+		if image.Pt(pos.X, pos.Y).In(cr) {
+			ret = append(ret, pos)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Y != ret[j].Y {
+			return ret[i].Y < ret[j].Y
+		}
+		return ret[i].X < ret[j].X
+	})
+	return ret
+}
+
+// extent returns the area covered by the chunks
+func (c chunks) extent() image.Rectangle {
+	r := image.Rectangle{}
+	for pos := range c {
+		r = r.Union(pos.Rect())
+	}
+	return r
+}
+
+// read copies the chunks within dst bounds into dst
+func (c chunks) read(dst *image.RGBA) {
+	b := dst.Bounds()
+	draw.Draw(dst, b, image.Transparent, image.Point{}, draw.Src)
+	cr := ChunksIn(b)
+	for y := cr.Min.Y; y < cr.Max.Y; y++ {
+		for x := cr.Min.X; x < cr.Max.X; x++ {
+			img, ok := c[ChunkPos{x, y}]
+			if !ok {
+				continue
+			}
+			r := img.Bounds().Intersect(b)
+			draw.Draw(dst, r, img, r.Min, draw.Src)
+		}
+	}
+}
+
+// write draws src within r on the chunks with op, chunks are only
+// created where src isn't blank and the ones left blank are removed
+func (c chunks) write(src *image.RGBA, r image.Rectangle, op draw.Op) {
+	r = r.Intersect(src.Bounds())
+	cr := ChunksIn(r)
+	for y := cr.Min.Y; y < cr.Max.Y; y++ {
+		for x := cr.Min.X; x < cr.Max.X; x++ {
+			pos := ChunkPos{x, y}
+			pr := pos.Rect().Intersect(r)
+			img, ok := c[pos]
+			if !ok {
+				if isBlank(src, pr) {
+					continue
+				}
+				img = image.NewRGBA(pos.Rect())
+				c[pos] = img
+			}
+			draw.Draw(img, pr, src, pr.Min, op)
+			if op == draw.Src {
+				c.prune(pos)
+			}
+		}
+	}
+}
+
+// prune removes the chunk at pos if it is blank
+func (c chunks) prune(pos ChunkPos) {
+	if img, ok := c[pos]; ok && isBlank(img, img.Bounds()) {
+		delete(c, pos)
+	}
+}
+
+// retain removes the chunks outside the cr chunk range
+func (c chunks) retain(cr image.Rectangle) {
+	for pos := range c {
+		if !image.Pt(pos.X, pos.Y).In(cr) {
+			delete(c, pos)
+		}
+	}
+}
+
+// copyTo makes dst a copy of c reusing its buffers
+func (c chunks) copyTo(dst chunks) chunks {
+	if dst == nil {
+		dst = chunks{}
+	}
+	for pos := range dst {
+		if _, ok := c[pos]; !ok {
+			delete(dst, pos)
+		}
+	}
+	for pos, img := range c {
+		d, ok := dst[pos]
+		if !ok {
+			d = image.NewRGBA(img.Bounds())
+			dst[pos] = d
+		}
+		copy(d.Pix, img.Pix)
+	}
+	return dst
+}
+
+// scratch returns a transparent image covering r and a context drawing on
+// it in canvas coordinates, draw2d only rasterizes images at the origin
+func (p *BufPainter) scratch(r image.Rectangle) (*image.RGBA, *draw2dimg.GraphicContext) {
+	img := image.NewRGBA(r)
+	origin := &image.RGBA{
+		Pix:    img.Pix,
+		Stride: img.Stride,
+		Rect:   image.Rect(0, 0, r.Dx(), r.Dy()),
+	}
+	c := draw2dimg.NewGraphicContext(origin)
+	c.FontCache = p.Fonts
+	c.Translate(float64(-r.Min.X), float64(-r.Min.Y))
+	return img, c
+}
+
+// paintOver runs fn on a scratch image covering r and draws the result
+// over the layer
+func (p *BufPainter) paintOver(name string, r image.Rectangle, fn func(c draw2d.GraphicContext)) error {
+	l := p.layer(name)
+	if l == nil {
+		return errUnknownLayer
+	}
+	if r.Empty() {
+		return nil
+	}
+	img, c := p.scratch(r)
+	fn(c)
+	l.chunks.write(img, r, draw.Over)
+	return nil
+}
+
+// Extent returns the area covered by the drawn chunks of the composite
+func (p *BufPainter) Extent() image.Rectangle {
+	return p.canvas.extent()
+}
+
+// layersExtent returns the area covered by the chunks of every layer,
+// hidden ones included
+func (p *BufPainter) layersExtent() image.Rectangle {
+	r := image.Rectangle{}
+	for _, l := range p.layers {
+		r = r.Union(l.chunks.extent())
+	}
+	return r
+}
+
+// ReadRegion copies the composite within dst bounds into dst
+func (p *BufPainter) ReadRegion(dst *image.RGBA) {
+	p.canvas.read(dst)
+}
+
+// Region returns a copy of the composite within r
+func (p *BufPainter) Region(r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(r)
+	p.canvas.read(img)
+	return img
+}
+
+// Retain drops the chunks outside the cr chunk range from every layer and
+// the composite, i.e. a client forgetting what it doesn't show
+func (p *BufPainter) Retain(cr image.Rectangle) {
+	for _, l := range p.layers {
+		l.chunks.retain(cr)
+	}
+	for pos := range p.canvas {
+		if !image.Pt(pos.X, pos.Y).In(cr) {
+			p.markDirty(pos.Rect())
+		}
+	}
+	p.canvas.retain(cr)
+}
@@ -0,0 +1,42 @@
+package painter
+
+import "encoding/json"
+
+// Codec is a wire encoding for Messages, the value doubles as the
+// websocket subprotocol name used to negotiate it
+type Codec string
+
+const (
+	CodecJSON   Codec = "arty.json"
+	CodecBinary Codec = "arty.binary"
+)
+
+// Codecs lists the supported codecs in order of preference
+var Codecs = []Codec{CodecBinary, CodecJSON}
+
+// ParseCodec returns the codec for a subprotocol name, JSON by default
+func ParseCodec(name string) Codec {
+	if Codec(name) == CodecBinary {
+		return CodecBinary
+	}
+	return CodecJSON
+}
+
+func (c Codec) Marshal(m Message) ([]byte, error) {
+	if c == CodecBinary {
+		return m.MarshalBinary()
+	}
+	return json.Marshal(m)
+}
+
+// Decode unmarshals a Message in either encoding, JSON messages always
+// start with '{' which is never a valid binary op code
+func Decode(data []byte) (Message, error) {
+	m := Message{}
+	if len(data) > 0 && data[0] == '{' {
+		err := json.Unmarshal(data, &m)
+		return m, err
+	}
+	err := m.UnmarshalBinary(data)
+	return m, err
+}
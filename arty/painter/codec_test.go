@@ -0,0 +1,209 @@
+package painter
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+func testImage(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTiles(t *testing.T) []TileOP {
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Init(InitOP{})
+	p.Rect(RectOP{Color: color.RGBA{0, 0, 255, 255}, Width: 1, Fill: true, X1: 300, Y1: 20, X2: 340, Y2: 60})
+	tiles, err := p.Tiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tiles
+}
+
+// testOps returns a drawing session using every op the painter handles
+func testOps(t *testing.T) []interface{} {
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 128, 0, 200}
+	a := Attr{Author: "a", Stroke: 1}
+	b := Attr{Author: "b", Stroke: 1, Layer: "top"}
+	ops := []interface{}{
+		InitOP{Layers: []LayerInfo{{Name: DefaultLayer, Opacity: 255}}},
+		LayerOP{LayerInfo: LayerInfo{Name: "top", Opacity: 128, Blend: BlendMultiply}, At: 1},
+		LineOP{Attr: a, Color: red, Width: 3, X1: 10.1, Y1: 10, X2: 120.3, Y2: 80.7},
+		RectOP{Attr: b, Color: green, Width: 2, X1: 20, Y1: 20, X2: 90, Y2: 70},
+		RectOP{Attr: a, Color: red, Fill: true, X1: 130, Y1: 10, X2: 160, Y2: 40},
+		EllipseOP{Attr: b, Color: green, Width: 4, X: 60, Y: 120, RX: 40, RY: 20.5},
+		PolylineOP{Attr: a, Color: red, Width: 1.1, Points: []Point{{5.1, 150.2}, {40, 170}, {80.3, 140.7}}},
+		TextOP{Attr: a, Color: red, Size: 16, X: 10, Y: 200, Text: "hello\nwire", Wrap: 100, Align: 1},
+		FloodFillOP{Attr: Attr{Author: "a", Stroke: 2}, Color: green, X: 145, Y: 25, Tolerance: 10},
+		BrushOP{Attr: b, Color: red, Brush: Brush{Size: 12, Opacity: 200, Hardness: 0.5, Spacing: 0.25, Texture: "noise"},
+			Points: []BrushPoint{{200, 50, 1}, {230, 80, 0.5}, {260, 60, 0.75}}},
+		ImageOP{Attr: Attr{Author: "b", Stroke: 2}, Data: testImage(t), X: 180, Y: 150, Scale: 2, Rotation: 0.5},
+		UndoOP{Author: "b"},
+		RedoOP{Author: "b"},
+		UndoOP{Author: "a"},
+		ClearRectOP{Attr: Attr{Author: "c", Stroke: 1}, X: 30, Y: 30, Width: 20, Height: 20},
+		LayerOP{LayerInfo: LayerInfo{Name: "top", Hidden: true}, At: 1},
+	}
+	for _, tile := range testTiles(t) {
+		ops = append(ops, tile)
+	}
+	return ops
+}
+
+func newTestPainter(t *testing.T) *BufPainter {
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.EnableHistory()
+	return p
+}
+
+func TestCodecDraw(t *testing.T) {
+	pj := newTestPainter(t)
+	pb := newTestPainter(t)
+	for i, op := range testOps(t) {
+		m := Message{Seq: uint64(i + 1), Ref: uint32(1000 + i), Payload: op}
+		jdata, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("op %d %T: json marshal: %v", i, op, err)
+		}
+		bdata, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("op %d %T: binary marshal: %v", i, op, err)
+		}
+		for _, data := range [][]byte{jdata, bdata} {
+			got, err := Decode(data)
+			if err != nil {
+				t.Fatalf("op %d %T: decode: %v", i, op, err)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Fatalf("op %d: decoded %#v, want %#v", i, got, m)
+			}
+		}
+		if err := pj.HandleRaw(jdata); err != nil {
+			t.Fatalf("op %d %T: json: %v", i, op, err)
+		}
+		if err := pb.HandleRaw(bdata); err != nil {
+			t.Fatalf("op %d %T: binary: %v", i, op, err)
+		}
+		if !reflect.DeepEqual(pj.Extent(), pb.Extent()) {
+			t.Fatalf("op %d %T: extent %v != %v", i, op, pj.Extent(), pb.Extent())
+		}
+		r := pj.Extent()
+		if !bytes.Equal(pj.Region(r).Pix, pb.Region(r).Pix) {
+			t.Fatalf("op %d %T: json and binary canvases differ", i, op)
+		}
+	}
+	if pj.Extent().Empty() {
+		t.Fatal("nothing drawn")
+	}
+}
+
+func TestCodecMessages(t *testing.T) {
+	ops := []interface{}{
+		ErrorOP{Reason: "nope"},
+		ViewOP{X: -2, Y: 3, Width: 4, Height: 5},
+		PresenceOP{Author: "a", Name: "Ann", Color: color.RGBA{1, 2, 3, 255}, Self: true, Role: RoleAdmin},
+		CursorOP{Author: "a", X: -10.5, Y: 20},
+		ClearOP{},
+		KickOP{Target: "b"},
+		EraseOP{Target: "b", Since: 1500000000},
+		BanOP{Target: "b"},
+	}
+	for _, op := range ops {
+		m := Message{Seq: 7, Ref: 1 << 31, Payload: op}
+		for _, codec := range Codecs {
+			data, err := codec.Marshal(m)
+			if err != nil {
+				t.Fatalf("%s %T: %v", codec, op, err)
+			}
+			got, err := Decode(data)
+			if err != nil {
+				t.Fatalf("%s %T: %v", codec, op, err)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Errorf("%s: decoded %#v, want %#v", codec, got, m)
+			}
+		}
+	}
+}
+
+func TestBinaryFloats(t *testing.T) {
+	for _, v := range []float64{0.1, 1.0 / 3, -1e-9, 123456.789, MaxCoord - 0.3} {
+		m := Message{Payload: CursorOP{X: v, Y: -v}}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := Message{}
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("%v decoded as %#v", v, got.Payload)
+		}
+	}
+}
+
+func TestUnmarshalBinaryInvalid(t *testing.T) {
+	for i, op := range testOps(t) {
+		data, err := Message{Seq: 300, Ref: 70000, Payload: op}.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(data); n++ {
+			m := Message{}
+			if err := m.UnmarshalBinary(data[:n]); err == nil {
+				t.Fatalf("op %d %T truncated to %d of %d bytes: no error", i, op, n, len(data))
+			}
+		}
+	}
+
+	garbage := [][]byte{
+		nil,
+		{0},
+		{200, 1},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		// text op with a huge string length
+		append([]byte{opText}, append(make([]byte, 33), 0xff, 0xff, 0xff, 0xff, 0x0f)...),
+		// polyline with more points than bytes
+		append([]byte{opPolyline}, append(make([]byte, 17), 0xff, 0xff, 0x03)...),
+	}
+	for _, data := range garbage {
+		m := Message{}
+		if err := m.UnmarshalBinary(data); err == nil {
+			t.Errorf("%v: no error, got %#v", data, m)
+		}
+	}
+
+	// Random bytes must never panic
+	seed := uint32(1)
+	for i := 0; i < 2000; i++ {
+		data := make([]byte, 1+i%64)
+		for j := range data {
+			seed = seed*1664525 + 1013904223
+			data[j] = byte(seed >> 24)
+		}
+		data[0] = byte(1 + i%opBan)
+		m := Message{}
+		m.UnmarshalBinary(data)
+	}
+}
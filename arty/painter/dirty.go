@@ -0,0 +1,58 @@
+package painter
+
+import (
+	"bytes"
+	"image"
+)
+
+// maxDirty bounds the dirty rectangles kept, past it they are merged in one
+const maxDirty = 32
+
+// markDirty adds r to the areas of the composite changed since the last
+// Dirty call, rectangles overlapping r are merged with it
+func (p *BufPainter) markDirty(r image.Rectangle) {
+	if r.Empty() {
+		return
+	}
+	for i := 0; i < len(p.dirty); {
+		if !p.dirty[i].Overlaps(r) {
+			i++
+			continue
+		}
+		// The union may overlap rectangles checked before
+		r = r.Union(p.dirty[i])
+		p.dirty = append(p.dirty[:i], p.dirty[i+1:]...)
+		i = 0
+	}
+	p.dirty = append(p.dirty, r)
+	if len(p.dirty) > maxDirty {
+		u := image.Rectangle{}
+		for _, d := range p.dirty {
+			u = u.Union(d)
+		}
+		p.dirty = append(p.dirty[:0], u)
+	}
+}
+
+// Dirty returns the areas of the composite changed since the last call,
+// they don't overlap
+func (p *BufPainter) Dirty() []image.Rectangle {
+	ret := p.dirty
+	p.dirty = nil
+	return ret
+}
+
+// markChanged marks the chunks that differ between the composites c and
+// next as dirty
+func (p *BufPainter) markChanged(c, next chunks) {
+	for pos, img := range c {
+		if n, ok := next[pos]; !ok || !bytes.Equal(img.Pix, n.Pix) {
+			p.markDirty(pos.Rect())
+		}
+	}
+	for pos := range next {
+		if _, ok := c[pos]; !ok {
+			p.markDirty(pos.Rect())
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package painter
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestMarkDirtyMerge(t *testing.T) {
+	p := &BufPainter{}
+	p.markDirty(image.Rect(0, 0, 10, 10))
+	p.markDirty(image.Rect(20, 0, 30, 10))
+	p.markDirty(image.Rect(0, 50, 10, 60))
+	p.markDirty(image.Rect(5, 100, 5, 200)) // empty
+	// Overlaps the first two, the union then overlaps the third
+	p.markDirty(image.Rect(5, 5, 25, 55))
+
+	got := p.Dirty()
+	want := []image.Rectangle{image.Rect(0, 0, 30, 60)}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dirty %v, want %v", got, want)
+	}
+}
+
+func TestMarkDirtyDisjoint(t *testing.T) {
+	p := &BufPainter{}
+	rects := []image.Rectangle{
+		image.Rect(0, 0, 10, 10),
+		image.Rect(10, 0, 20, 10), // touching doesn't overlap
+		image.Rect(0, 20, 10, 30),
+	}
+	for _, r := range rects {
+		p.markDirty(r)
+	}
+	if got := p.Dirty(); !reflect.DeepEqual(got, rects) {
+		t.Fatalf("dirty %v, want %v", got, rects)
+	}
+}
+
+func TestMarkDirtyCollapse(t *testing.T) {
+	p := &BufPainter{}
+	for i := 0; i < maxDirty; i++ {
+		p.markDirty(image.Rect(i*10, 0, i*10+5, 5))
+	}
+	if n := len(p.dirty); n != maxDirty {
+		t.Fatalf("%d dirty rectangles, want %d", n, maxDirty)
+	}
+	p.markDirty(image.Rect(0, 100, 5, 105))
+	got := p.Dirty()
+	want := []image.Rectangle{image.Rect(0, 0, (maxDirty-1)*10+5, 105)}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dirty %v, want %v", got, want)
+	}
+}
+
+func TestDirtyReset(t *testing.T) {
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Init(InitOP{})
+	p.Dirty()
+	if err := p.HandleOP(RectOP{Color: color.RGBA{255, 0, 0, 255}, Fill: true, X1: 10, Y1: 10, X2: 20, Y2: 20}); err != nil {
+		t.Fatal(err)
+	}
+	d := p.Dirty()
+	if len(d) != 1 || !image.Rect(10, 10, 20, 20).In(d[0]) {
+		t.Fatalf("dirty %v doesn't cover the rect", d)
+	}
+	if d := p.Dirty(); d != nil {
+		t.Fatalf("dirty %v after reset", d)
+	}
+}
+
+// testChunks returns a painter with a filled square on each of the chunks
+func testChunks(t *testing.T, pos ...ChunkPos) *BufPainter {
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Init(InitOP{})
+	for _, c := range pos {
+		r := c.Rect()
+		err := p.HandleOP(RectOP{
+			Color: color.RGBA{0, 0, 255, 255}, Fill: true,
+			X1: float64(r.Min.X + 10), Y1: float64(r.Min.Y + 10),
+			X2: float64(r.Min.X + 20), Y2: float64(r.Min.Y + 20),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Dirty()
+	return p
+}
+
+func TestMarkChanged(t *testing.T) {
+	same, changed, removed, added := ChunkPos{0, 0}, ChunkPos{2, 0}, ChunkPos{0, 2}, ChunkPos{2, 2}
+	p := testChunks(t, same, changed, removed)
+	src := testChunks(t, same, changed, added)
+	r := changed.Rect()
+	err := src.HandleOP(RectOP{
+		Color: color.RGBA{255, 0, 0, 255}, Fill: true,
+		X1: float64(r.Min.X + 50), Y1: float64(r.Min.Y + 50),
+		X2: float64(r.Min.X + 60), Y2: float64(r.Min.Y + 60),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Copy(src)
+	got := map[image.Rectangle]bool{}
+	for _, d := range p.Dirty() {
+		got[d] = true
+	}
+	want := map[image.Rectangle]bool{
+		changed.Rect(): true,
+		removed.Rect(): true,
+		added.Rect():   true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dirty %v, want %v", got, want)
+	}
+}
+
+func TestRetainDirty(t *testing.T) {
+	p := testChunks(t, ChunkPos{0, 0}, ChunkPos{1, 0}, ChunkPos{3, 3})
+	p.Retain(image.Rect(0, 0, 2, 1))
+	got := p.Dirty()
+	want := []image.Rectangle{ChunkPos{3, 3}.Rect()}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dirty %v, want %v", got, want)
+	}
+	if e := p.Extent(); e != ChunkRect(image.Rect(0, 0, 2, 1)) {
+		t.Fatalf("extent %v after retain", e)
+	}
+}
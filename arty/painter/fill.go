@@ -0,0 +1,94 @@
+package painter
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// fillArea returns the area a fill may spread over, the drawn extent of
+// the canvas grown to include the fill point and at most MaxOpSize across
+// around it
+func (p *BufPainter) fillArea(op FloodFillOP) image.Rectangle {
+	start := image.Rect(op.X, op.Y, op.X+1, op.Y+1)
+	limit := image.Rect(
+		op.X-MaxOpSize/2, op.Y-MaxOpSize/2,
+		op.X+MaxOpSize/2, op.Y+MaxOpSize/2,
+	)
+	return p.layersExtent().Union(start).Intersect(limit)
+}
+
+// FloodFill replaces the color of the area connected to op.X, op.Y within
+// its fill area, it returns the filled bounds
+func (p *BufPainter) FloodFill(op FloodFillOP) image.Rectangle {
+	l := p.layer(op.Layer)
+	if l == nil {
+		return image.Rectangle{}
+	}
+	b := p.fillArea(op)
+	img := image.NewRGBA(b)
+	l.chunks.read(img)
+	start := image.Pt(op.X, op.Y)
+	if !start.In(b) {
+		return image.Rectangle{}
+	}
+	target := img.RGBAAt(op.X, op.Y)
+	if target == op.Color {
+		return image.Rectangle{}
+	}
+	// filled marks visited pixels so tolerance never loops back
+	filled := make([]bool, b.Dx()*b.Dy())
+	idx := func(x, y int) int { return (y-b.Min.Y)*b.Dx() + x - b.Min.X }
+	open := func(x, y int) bool {
+		return !filled[idx(x, y)] && similar(img.RGBAAt(x, y), target, op.Tolerance)
+	}
+	r := image.Rectangle{}
+	stack := []image.Point{start}
+	for len(stack) > 0 {
+		pt := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !open(pt.X, pt.Y) {
+			continue
+		}
+		// expand the span left and right
+		x0, x1 := pt.X, pt.X
+		for x0 > b.Min.X && open(x0-1, pt.Y) {
+			x0--
+		}
+		for x1 < b.Max.X-1 && open(x1+1, pt.Y) {
+			x1++
+		}
+		for x := x0; x <= x1; x++ {
+			img.SetRGBA(x, pt.Y, op.Color)
+			filled[idx(x, pt.Y)] = true
+		}
+		// push one seed per matching run on the rows above and below
+		for _, y := range []int{pt.Y - 1, pt.Y + 1} {
+			if y < b.Min.Y || y >= b.Max.Y {
+				continue
+			}
+			for x := x0; x <= x1; x++ {
+				if open(x, y) && (x == x0 || !open(x-1, y)) {
+					stack = append(stack, image.Pt(x, y))
+				}
+			}
+		}
+		r = r.Union(image.Rect(x0, pt.Y, x1+1, pt.Y+1))
+	}
+	l.chunks.write(img, r, draw.Src)
+	return r
+}
+
+func similar(a, b color.RGBA, tolerance uint8) bool {
+	return absDiff(a.R, b.R) <= tolerance &&
+		absDiff(a.G, b.G) <= tolerance &&
+		absDiff(a.B, b.B) <= tolerance &&
+		absDiff(a.A, b.A) <= tolerance
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
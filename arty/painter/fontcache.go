@@ -1,20 +1,109 @@
 package painter
 
 import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+
 	"github.com/golang/freetype/truetype"
 	"github.com/llgcode/draw2d"
+	"github.com/stdiopt/gowasm-experiments/arty/painter/font"
+)
+
+const (
+	// DefaultFont is the embedded font family used by TextOPs without one
+	DefaultFont = "roboto"
+	// DefaultStyle is the style used by TextOPs without one
+	DefaultStyle = "regular"
 )
 
+// FontCache holds fonts by family and style, names are case insensitive
 type FontCache map[string]*truetype.Font
 
-func (f FontCache) Load(fd draw2d.FontData) (*truetype.Font, error) {
-	font, ok := f[fd.Name]
+// NewFontCache returns a cache with the embedded font
+func NewFontCache() (FontCache, error) {
+	tf, err := truetype.Parse(font.Data["font.ttf"])
+	if err != nil {
+		return nil, err
+	}
+	f := FontCache{}
+	f.Add(DefaultFont, DefaultStyle, tf)
+	return f, nil
+}
+
+func fontKey(family, style string) string {
+	if family == "" {
+		family = DefaultFont
+	}
+	if style == "" {
+		style = DefaultStyle
+	}
+	return strings.ToLower(family) + ":" + strings.ToLower(style)
+}
+
+// Font returns the font for family and style, empty names are the defaults
+func (f FontCache) Font(family, style string) (*truetype.Font, error) {
+	tf, ok := f[fontKey(family, style)]
 	if !ok {
-		return f["roboto"], nil
+		return nil, fmt.Errorf("unknown font %q style %q", family, style)
+	}
+	return tf, nil
+}
+
+// Add registers tf as family and style
+func (f FontCache) Add(family, style string, tf *truetype.Font) {
+	f[fontKey(family, style)] = tf
+}
+
+// LoadDir loads the fonts in dir, see LoadFS
+func (f FontCache) LoadDir(dir string) error {
+	return f.LoadFS(os.DirFS(dir))
+}
+
+// LoadFS loads every .ttf and .otf file in fsys, family and style come
+// from the font name table (i.e. "Roboto" and "Bold Italic"), only
+// TrueType outlines are supported, other files (i.e. CFF .otf) are logged
+// and skipped
+func (f FontCache) LoadFS(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if d.IsDir() || (ext != ".ttf" && ext != ".otf") {
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		tf, err := truetype.Parse(data)
+		if err != nil {
+			log.Printf("skipping font %s: %v", name, err)
+			return nil
+		}
+		family := tf.Name(truetype.NameIDFontFamily)
+		if family == "" {
+			family = strings.TrimSuffix(path.Base(name), path.Ext(name))
+		}
+		f.Add(family, tf.Name(truetype.NameIDFontSubfamily), tf)
+		return nil
+	})
+}
+
+// Load implements draw2d.FontCache, fd.Name is a family or a key set by
+// the painter
+func (f FontCache) Load(fd draw2d.FontData) (*truetype.Font, error) {
+	if tf, ok := f[fd.Name]; ok {
+		return tf, nil
 	}
-	return font, nil
+	return f.Font(fd.Name, "")
 }
 
-func (f *FontCache) Store(fd draw2d.FontData, tf *truetype.Font) {
-	(*f)[fd.Name] = tf
+// Store implements draw2d.FontCache
+func (f FontCache) Store(fd draw2d.FontData, tf *truetype.Font) {
+	f.Add(fd.Name, "", tf)
 }
@@ -0,0 +1,27 @@
+package painter
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter/font"
+)
+
+func TestLoadFSSkipsInvalid(t *testing.T) {
+	fsys := fstest.MapFS{
+		"cff.otf":          {Data: []byte("OTTO\x00\x0a\x00\x80\x00\x03\x00\x20")},
+		"broken.ttf":       {Data: []byte("not a font")},
+		"fonts/extra.ttf":  {Data: font.Data["font.ttf"]},
+		"fonts/readme.txt": {Data: []byte("ignored")},
+	}
+	f := FontCache{}
+	if err := f.LoadFS(fsys); err != nil {
+		t.Fatal(err)
+	}
+	if len(f) != 1 {
+		t.Fatalf("%d fonts loaded, want 1", len(f))
+	}
+	if _, err := f.Font("Roboto Mono", "Regular"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,231 @@
+package painter
+
+import (
+	"image"
+	"time"
+)
+
+const (
+	checkpointEvery = 64
+	maxCheckpoints  = 8
+	// maxCheckpointBytes bounds the chunks kept by checkpoints, large
+	// canvases get fewer of them but never less than two
+	maxCheckpointBytes = 64 << 20
+)
+
+type histEntry struct {
+	op     interface{}
+	attr   Attr
+	bounds image.Rectangle
+	undone bool
+	time   time.Time
+}
+
+// checkpoint is a copy of the layers before entry at was drawn, size bytes
+// long
+type checkpoint struct {
+	at     int
+	layers []savedLayer
+	size   int
+}
+
+// history keeps the recent ops and periodic canvas checkpoints so strokes
+// can be removed or restored by replaying from the nearest checkpoint, ops
+// older than the first checkpoint are forgotten
+type history struct {
+	entries     []histEntry
+	checkpoints []checkpoint
+	// undone strokes per author, most recent last
+	redo map[string][]int
+}
+
+func (h *history) reset(layers []*layer) {
+	h.entries = nil
+	h.checkpoints = []checkpoint{{at: 0, layers: saveLayers(nil, layers), size: layersSize(layers)}}
+	h.redo = map[string][]int{}
+}
+
+// checkpoint copies layers if enough entries were recorded since the last
+// one, the oldest checkpoints are dropped to stay within maxCheckpoints and
+// maxCheckpointBytes
+func (h *history) checkpoint(layers []*layer) {
+	if h == nil {
+		return
+	}
+	last := h.checkpoints[len(h.checkpoints)-1]
+	if len(h.entries)-last.at < checkpointEvery {
+		return
+	}
+	size := layersSize(layers)
+	var buf []savedLayer
+	for len(h.checkpoints) > 1 && (len(h.checkpoints) >= maxCheckpoints || h.size()+size > maxCheckpointBytes) {
+		// Reuse the oldest checkpoint buffer
+		buf = h.checkpoints[0].layers
+		h.dropOldest()
+	}
+	h.checkpoints = append(h.checkpoints, checkpoint{
+		at:     len(h.entries),
+		layers: saveLayers(buf, layers),
+		size:   size,
+	})
+}
+
+// dropOldest forgets the first checkpoint and the entries before the next
+// one
+func (h *history) dropOldest() {
+	base := h.checkpoints[1].at
+	h.entries = append(h.entries[:0], h.entries[base:]...)
+	h.checkpoints = append(h.checkpoints[:0], h.checkpoints[1:]...)
+	for i := range h.checkpoints {
+		h.checkpoints[i].at -= base
+	}
+}
+
+// size returns the bytes kept by the checkpoints
+func (h *history) size() int {
+	n := 0
+	for _, c := range h.checkpoints {
+		n += c.size
+	}
+	return n
+}
+
+// layersSize returns the bytes a copy of the layers chunks takes
+func layersSize(layers []*layer) int {
+	n := 0
+	for _, l := range layers {
+		n += len(l.chunks) * ChunkSize * ChunkSize * 4
+	}
+	return n
+}
+
+func (h *history) record(op interface{}, bounds image.Rectangle, t time.Time) {
+	if h == nil {
+		return
+	}
+	a := attrOf(op)
+	if a.Author != "" {
+		delete(h.redo, a.Author)
+	}
+	h.entries = append(h.entries, histEntry{op: op, attr: a, bounds: bounds, time: t})
+}
+
+// lastStroke returns the last stroke of author that is not undone
+func (h *history) lastStroke(author string) (int, bool) {
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if e.attr.Author == author && !e.undone {
+			return e.attr.Stroke, true
+		}
+	}
+	return 0, false
+}
+
+// lastText returns the entry of the last TextOP of author and stroke that
+// is not undone
+func (h *history) lastText(author string, stroke int) (int, bool) {
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if _, ok := e.op.(TextOP); !ok || e.undone {
+			continue
+		}
+		if e.attr.Author == author && e.attr.Stroke == stroke {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// mark sets the undone state of a stroke, it returns the index of its first
+// entry and the area it covers
+func (h *history) mark(author string, stroke int, undone bool) (int, image.Rectangle, bool) {
+	first := -1
+	r := image.Rectangle{}
+	for i := range h.entries {
+		e := &h.entries[i]
+		if e.attr.Author != author || e.attr.Stroke != stroke {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		e.undone = undone
+		r = r.Union(e.bounds)
+	}
+	return first, r, first != -1
+}
+
+// EnableHistory makes the painter keep the ops needed for Undo and Redo,
+// it must be called before Init
+func (p *BufPainter) EnableHistory() {
+	p.history = &history{}
+}
+
+// Undo removes the last stroke of author
+func (p *BufPainter) Undo(author string) {
+	h := p.history
+	if h == nil || author == "" {
+		return
+	}
+	stroke, ok := h.lastStroke(author)
+	if !ok {
+		return
+	}
+	first, r, _ := h.mark(author, stroke, true)
+	h.redo[author] = append(h.redo[author], stroke)
+	p.rebuild(first, r)
+}
+
+// Redo restores the last stroke undone by author
+func (p *BufPainter) Redo(author string) {
+	h := p.history
+	if h == nil {
+		return
+	}
+	stack := h.redo[author]
+	if len(stack) == 0 {
+		return
+	}
+	stroke := stack[len(stack)-1]
+	h.redo[author] = stack[:len(stack)-1]
+	first, r, ok := h.mark(author, stroke, false)
+	if !ok {
+		return
+	}
+	p.rebuild(first, r)
+}
+
+// rebuild restores the checkpoint before entry first and replays the
+// remaining entries, later checkpoints are refreshed on the way, it returns
+// the first error drawing an entry, only an edited one can fail as the
+// others are drawn as they were
+func (p *BufPainter) rebuild(first int, r image.Rectangle) error {
+	h := p.history
+	cp := 0
+	for i, c := range h.checkpoints {
+		if c.at <= first {
+			cp = i
+		}
+	}
+	p.loadLayers(h.checkpoints[cp].layers)
+	next := cp + 1
+	var ret error
+	for i := h.checkpoints[cp].at; i < len(h.entries); i++ {
+		if next < len(h.checkpoints) && h.checkpoints[next].at == i {
+			h.checkpoints[next].layers = saveLayers(h.checkpoints[next].layers, p.layers)
+			h.checkpoints[next].size = layersSize(p.layers)
+			next++
+		}
+		if h.entries[i].undone {
+			continue
+		}
+		if _, err := p.draw(h.entries[i].op); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	p.composite(r)
+	if p.OnRebuild != nil {
+		p.OnRebuild(r)
+	}
+	return ret
+}
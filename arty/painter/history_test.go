@@ -0,0 +1,77 @@
+package painter
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCheckpointBytes(t *testing.T) {
+	p := newTestPainter(t)
+	p.Init(InitOP{})
+	// Enough chunks for a checkpoint to take more than half the budget
+	chunks := maxCheckpointBytes/(ChunkSize*ChunkSize*4)/2 + 8
+	pos := []ChunkPos{}
+	for i := 0; i < chunks; i++ {
+		pos = append(pos, ChunkPos{i % 16, i / 16})
+	}
+	for _, c := range pos {
+		r := c.Rect()
+		err := p.HandleOP(RectOP{
+			Color: color.RGBA{0, 0, 255, 255}, Fill: true,
+			X1: float64(r.Min.X + 10), Y1: float64(r.Min.Y + 10),
+			X2: float64(r.Min.X + 20), Y2: float64(r.Min.Y + 20),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4*checkpointEvery; i++ {
+		err := p.HandleOP(LineOP{
+			Attr:  Attr{Author: "a", Stroke: i},
+			Color: color.RGBA{255, 0, 0, 255}, Width: 1,
+			X1: 5, Y1: float64(i), X2: 50, Y2: float64(i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := p.history
+	if n := len(h.checkpoints); n != 2 {
+		t.Fatalf("%d checkpoints of %d bytes each, want 2", n, h.checkpoints[0].size)
+	}
+	if size := h.size(); size > 2*layersSize(p.layers) {
+		t.Fatalf("checkpoints take %d bytes", size)
+	}
+
+	// The latest strokes can still be undone
+	r := image.Rect(0, 0, 60, 4*checkpointEvery)
+	before := p.Region(r).Pix
+	p.Undo("a")
+	if bytes.Equal(p.Region(r).Pix, before) {
+		t.Fatal("undo changed nothing")
+	}
+	p.Redo("a")
+	if !bytes.Equal(p.Region(r).Pix, before) {
+		t.Fatal("redo didn't restore the stroke")
+	}
+}
+
+func TestCheckpointCount(t *testing.T) {
+	p := newTestPainter(t)
+	p.Init(InitOP{})
+	for i := 0; i < 2*maxCheckpoints*checkpointEvery; i++ {
+		err := p.HandleOP(LineOP{
+			Attr:  Attr{Author: "a", Stroke: i},
+			Color: color.RGBA{255, 0, 0, 255}, Width: 1,
+			X1: 5, Y1: float64(i % 200), X2: 50, Y2: float64(i % 200),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(p.history.checkpoints); n != maxCheckpoints {
+		t.Fatalf("%d checkpoints, want %d", n, maxCheckpoints)
+	}
+}
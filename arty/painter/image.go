@@ -0,0 +1,90 @@
+package painter
+
+import (
+	"bytes"
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+
+	// Formats accepted by ImageOP
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Image decodes the op image and draws it on its layer
+func (p *BufPainter) Image(op ImageOP) error {
+	l := p.layer(op.Layer)
+	if l == nil {
+		return errUnknownLayer
+	}
+	r := imageBounds(op)
+	if r.Empty() {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(op.Data))
+	if err != nil {
+		return err
+	}
+	sr := img.Bounds()
+	w, h := float64(sr.Dx()), float64(sr.Dy())
+	// Scale and rotate around the image center then move the center in
+	// place, draw2d DrawImage can't be used as it transposes rotations
+	sin, cos := math.Sincos(op.Rotation)
+	a, b, c, d := op.Scale*cos, -op.Scale*sin, op.Scale*sin, op.Scale*cos
+	tx, ty := -w/2-float64(sr.Min.X), -h/2-float64(sr.Min.Y)
+	cx, cy := op.X+w*op.Scale/2, op.Y+h*op.Scale/2
+	m := f64.Aff3{a, b, cx + a*tx + b*ty, c, d, cy + c*tx + d*ty}
+	dst := image.NewRGBA(r)
+	draw.BiLinear.Transform(dst, m, img, sr, draw.Over, nil)
+	l.chunks.write(dst, r, draw.Over)
+	return nil
+}
+
+// imageBounds returns the area covered by the transformed image, the size
+// comes from the image header
+func imageBounds(op ImageOP) image.Rectangle {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(op.Data))
+	if err != nil {
+		return image.Rectangle{}
+	}
+	w, h := float64(cfg.Width)*op.Scale, float64(cfg.Height)*op.Scale
+	cx, cy := op.X+w/2, op.Y+h/2
+	sin, cos := math.Sincos(op.Rotation)
+	pts := make([]Point, 0, 4)
+	for _, d := range [][2]float64{{-1, -1}, {1, -1}, {1, 1}, {-1, 1}} {
+		dx, dy := d[0]*w/2, d[1]*h/2
+		pts = append(pts, Point{cx + dx*cos - dy*sin, cy + dx*sin + dy*cos})
+	}
+	return pointsRect(pts, 2)
+}
+
+// ScaledRegion returns the composite within r scaled by scale, chunks are
+// scaled one at a time so only the result is allocated
+func (p *BufPainter) ScaledRegion(r image.Rectangle, scale float64) *image.RGBA {
+	w := int(float64(r.Dx())*scale + 0.5)
+	h := int(float64(r.Dy())*scale + 0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	m := f64.Aff3{
+		scale, 0, -float64(r.Min.X) * scale,
+		0, scale, -float64(r.Min.Y) * scale,
+	}
+	for _, pos := range p.canvas.positions(ChunksIn(r)) {
+		img := p.canvas[pos]
+		sr := img.Bounds().Intersect(r)
+		if scale == 1 {
+			// Transform gets plain translations wrong
+			draw.Draw(dst, sr.Sub(r.Min), img, sr.Min, draw.Src)
+			continue
+		}
+		draw.ApproxBiLinear.Transform(dst, m, img, sr, draw.Src, nil)
+	}
+	return dst
+}
@@ -0,0 +1,263 @@
+package painter
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// DefaultLayer is the name of the single layer of a canvas initialized
+// without layers
+const DefaultLayer = "background"
+
+// MaxLayers is the number of layers a canvas can have
+const MaxLayers = 8
+
+// Blend modes of a layer
+const (
+	BlendNormal uint8 = iota
+	BlendMultiply
+	BlendScreen
+	BlendAdd
+)
+
+var (
+	errUnknownLayer = errors.New("unknown layer")
+	errTooManyLayer = errors.New("too many layers")
+	errLastLayer    = errors.New("can't delete the last layer")
+)
+
+// LayerInfo describes a layer, layers are composited bottom to top with
+// their Blend mode and Opacity, from 0 transparent to 255 opaque
+type LayerInfo struct {
+	Name    string
+	Hidden  bool
+	Opacity uint8
+	Blend   uint8
+}
+
+type layer struct {
+	LayerInfo
+	chunks chunks
+}
+
+// savedLayer is a copy of a layer kept by history checkpoints
+type savedLayer struct {
+	LayerInfo
+	chunks chunks
+}
+
+func (p *BufPainter) newLayer(info LayerInfo) *layer {
+	return &layer{LayerInfo: info, chunks: chunks{}}
+}
+
+// layer returns the named layer, an empty name is the bottom layer
+func (p *BufPainter) layer(name string) *layer {
+	if name == "" && len(p.layers) > 0 {
+		return p.layers[0]
+	}
+	for _, l := range p.layers {
+		if l.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+func (p *BufPainter) layerIndex(name string) int {
+	for i, l := range p.layers {
+		if l.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Layers returns the layers from bottom to top
+func (p *BufPainter) Layers() []LayerInfo {
+	ret := make([]LayerInfo, len(p.layers))
+	for i, l := range p.layers {
+		ret[i] = l.LayerInfo
+	}
+	return ret
+}
+
+// Layer adds, updates, moves or deletes a layer
+func (p *BufPainter) Layer(op LayerOP) error {
+	i := p.layerIndex(op.Name)
+	switch {
+	case op.Delete:
+		if i == -1 {
+			return errUnknownLayer
+		}
+		if len(p.layers) == 1 {
+			return errLastLayer
+		}
+		p.layers = append(p.layers[:i], p.layers[i+1:]...)
+		return nil
+	case i == -1:
+		if len(p.layers) >= MaxLayers {
+			return errTooManyLayer
+		}
+		p.layers = append(p.layers, p.newLayer(op.LayerInfo))
+		i = len(p.layers) - 1
+	default:
+		p.layers[i].LayerInfo = op.LayerInfo
+	}
+	// Move it to op.At
+	at := op.At
+	if at < 0 {
+		at = 0
+	}
+	if at >= len(p.layers) {
+		at = len(p.layers) - 1
+	}
+	l := p.layers[i]
+	p.layers = append(p.layers[:i], p.layers[i+1:]...)
+	p.layers = append(p.layers[:at], append([]*layer{l}, p.layers[at:]...)...)
+	return nil
+}
+
+// LayerRegion returns a copy of the named layer within r, nil if there is
+// no such layer
+func (p *BufPainter) LayerRegion(name string, r image.Rectangle) *image.RGBA {
+	l := p.layer(name)
+	if l == nil {
+		return nil
+	}
+	img := image.NewRGBA(r)
+	l.chunks.read(img)
+	return img
+}
+
+// SetLayerRegion replaces the pixels of the named layer within img bounds
+func (p *BufPainter) SetLayerRegion(name string, img *image.RGBA) error {
+	l := p.layer(name)
+	if l == nil {
+		return errUnknownLayer
+	}
+	l.chunks.write(img, img.Bounds(), draw.Src)
+	p.composite(img.Bounds())
+	return nil
+}
+
+// Copy makes p a copy of the src layers and canvas
+func (p *BufPainter) Copy(src *BufPainter) {
+	p.loadLayers(saveLayers(nil, src.layers))
+	p.markChanged(p.canvas, src.canvas)
+	p.canvas = src.canvas.copyTo(p.canvas)
+}
+
+// saveLayers copies layers into dst reusing its buffers
+func saveLayers(dst []savedLayer, layers []*layer) []savedLayer {
+	if len(dst) != len(layers) {
+		dst = make([]savedLayer, len(layers))
+	}
+	for i, l := range layers {
+		dst[i].LayerInfo = l.LayerInfo
+		dst[i].chunks = l.chunks.copyTo(dst[i].chunks)
+	}
+	return dst
+}
+
+// loadLayers replaces the layers with saved ones, the composite is not
+// updated
+func (p *BufPainter) loadLayers(saved []savedLayer) {
+	layers := make([]*layer, len(saved))
+	for i, s := range saved {
+		l := p.layer(s.Name)
+		if l == nil || l.Name != s.Name {
+			l = p.newLayer(s.LayerInfo)
+		}
+		l.LayerInfo = s.LayerInfo
+		l.chunks = s.chunks.copyTo(l.chunks)
+		layers[i] = l
+	}
+	p.layers = layers
+}
+
+// composite redraws the visible layers within r into the canvas chunks
+func (p *BufPainter) composite(r image.Rectangle) {
+	p.markDirty(r)
+	cr := ChunksIn(r)
+	for y := cr.Min.Y; y < cr.Max.Y; y++ {
+		for x := cr.Min.X; x < cr.Max.X; x++ {
+			p.compositeChunk(ChunkPos{x, y}, r)
+		}
+	}
+}
+
+// compositeChunk redraws the part of r within the chunk at pos
+func (p *BufPainter) compositeChunk(pos ChunkPos, r image.Rectangle) {
+	visible := []*layer{}
+	for _, l := range p.layers {
+		if _, ok := l.chunks[pos]; ok && !l.Hidden && l.Opacity > 0 {
+			visible = append(visible, l)
+		}
+	}
+	if len(visible) == 0 {
+		delete(p.canvas, pos)
+		return
+	}
+	dst, ok := p.canvas[pos]
+	if !ok {
+		dst = image.NewRGBA(pos.Rect())
+		p.canvas[pos] = dst
+	}
+	r = r.Intersect(pos.Rect())
+	draw.Draw(dst, r, image.Transparent, image.Point{}, draw.Src)
+	for _, l := range visible {
+		src := l.chunks[pos]
+		if l.Blend != BlendNormal {
+			blend(dst, src, r, l.Opacity, l.Blend)
+			continue
+		}
+		var mask image.Image
+		if l.Opacity < 255 {
+			mask = image.NewUniform(color.Alpha{l.Opacity})
+		}
+		draw.DrawMask(dst, r, src, r.Min, mask, image.Point{}, draw.Over)
+	}
+}
+
+// blend composites src over dst within r with a separable blend mode,
+// both are premultiplied
+func blend(dst, src *image.RGBA, r image.Rectangle, opacity, mode uint8) {
+	op := float64(opacity) / 255
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i, j := dst.PixOffset(x, y), src.PixOffset(x, y)
+			sa := float64(src.Pix[j+3]) / 255 * op
+			if sa == 0 {
+				continue
+			}
+			da := float64(dst.Pix[i+3]) / 255
+			for c := 0; c < 3; c++ {
+				cs := float64(src.Pix[j+c]) / 255 * op
+				cd := float64(dst.Pix[i+c]) / 255
+				b := cs / sa
+				if da > 0 {
+					b = blendFunc(mode, cd/da, cs/sa)
+				}
+				co := cs*(1-da) + cd*(1-sa) + sa*da*b
+				dst.Pix[i+c] = uint8(math.Min(co, 1)*255 + 0.5)
+			}
+			dst.Pix[i+3] = uint8((sa+da*(1-sa))*255 + 0.5)
+		}
+	}
+}
+
+// blendFunc mixes a backdrop and a source color component
+func blendFunc(mode uint8, cb, cs float64) float64 {
+	switch mode {
+	case BlendMultiply:
+		return cb * cs
+	case BlendScreen:
+		return cb + cs - cb*cs
+	case BlendAdd:
+		return math.Min(cb+cs, 1)
+	}
+	return cs
+}
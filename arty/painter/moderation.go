@@ -0,0 +1,49 @@
+package painter
+
+import (
+	"image"
+	"image/draw"
+	"time"
+)
+
+// ClearRect makes the op rectangle transparent on every layer
+func (p *BufPainter) ClearRect(op ClearRectOP) {
+	r := p.bounds(op)
+	cr := ChunksIn(r)
+	for _, l := range p.layers {
+		for _, pos := range l.chunks.positions(cr) {
+			draw.Draw(l.chunks[pos], pos.Rect().Intersect(r), image.Transparent, image.Point{}, draw.Src)
+			l.chunks.prune(pos)
+		}
+	}
+}
+
+// EraseAuthor removes every op of author drawn at or after since and
+// redraws the canvas without them, it reports false if history is disabled
+// or has no such op, ops older than history are kept
+func (p *BufPainter) EraseAuthor(author string, since time.Time) bool {
+	h := p.history
+	if h == nil || author == "" {
+		return false
+	}
+	first := -1
+	r := image.Rectangle{}
+	for i := range h.entries {
+		e := &h.entries[i]
+		if e.attr.Author != author || e.undone || e.time.Before(since) {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		e.undone = true
+		r = r.Union(e.bounds)
+	}
+	if first == -1 {
+		return false
+	}
+	// Erased strokes can't be redone
+	delete(h.redo, author)
+	p.rebuild(first, r)
+	return true
+}
@@ -4,80 +4,419 @@ import (
 	"encoding/json"
 	"errors"
 	"image/color"
+	"reflect"
 )
 
 const (
 	opInit = iota + 1
 	opLine
 	opText
+	opTile
+	opUndo
+	opRedo
+	opRect
+	opEllipse
+	opPolyline
+	opFloodFill
+	opError
+	opLayer
+	opBrush
+	opImage
+	opView
+	opPresence
+	opCursor
+	opClear
+	opKick
+	opClearRect
+	opErase
+	opBan
 )
 
+var errUnknownOP = errors.New("unknown operation")
+
+// opCode returns the wire code for a payload, 0 if unknown
+func opCode(payload interface{}) uint {
+	switch payload.(type) {
+	case InitOP:
+		return opInit
+	case LineOP:
+		return opLine
+	case TextOP:
+		return opText
+	case TileOP:
+		return opTile
+	case UndoOP:
+		return opUndo
+	case RedoOP:
+		return opRedo
+	case RectOP:
+		return opRect
+	case EllipseOP:
+		return opEllipse
+	case PolylineOP:
+		return opPolyline
+	case FloodFillOP:
+		return opFloodFill
+	case ErrorOP:
+		return opError
+	case LayerOP:
+		return opLayer
+	case BrushOP:
+		return opBrush
+	case ImageOP:
+		return opImage
+	case ViewOP:
+		return opView
+	case PresenceOP:
+		return opPresence
+	case CursorOP:
+		return opCursor
+	case ClearOP:
+		return opClear
+	case KickOP:
+		return opKick
+	case ClearRectOP:
+		return opClearRect
+	case EraseOP:
+		return opErase
+	case BanOP:
+		return opBan
+	}
+	return 0
+}
+
+// opPayload returns a pointer to a zero payload for the wire code
+func opPayload(op uint) (interface{}, error) {
+	switch op {
+	case opInit:
+		return &InitOP{}, nil
+	case opLine:
+		return &LineOP{}, nil
+	case opText:
+		return &TextOP{}, nil
+	case opTile:
+		return &TileOP{}, nil
+	case opUndo:
+		return &UndoOP{}, nil
+	case opRedo:
+		return &RedoOP{}, nil
+	case opRect:
+		return &RectOP{}, nil
+	case opEllipse:
+		return &EllipseOP{}, nil
+	case opPolyline:
+		return &PolylineOP{}, nil
+	case opFloodFill:
+		return &FloodFillOP{}, nil
+	case opError:
+		return &ErrorOP{}, nil
+	case opLayer:
+		return &LayerOP{}, nil
+	case opBrush:
+		return &BrushOP{}, nil
+	case opImage:
+		return &ImageOP{}, nil
+	case opView:
+		return &ViewOP{}, nil
+	case opPresence:
+		return &PresenceOP{}, nil
+	case opCursor:
+		return &CursorOP{}, nil
+	case opClear:
+		return &ClearOP{}, nil
+	case opKick:
+		return &KickOP{}, nil
+	case opClearRect:
+		return &ClearRectOP{}, nil
+	case opErase:
+		return &EraseOP{}, nil
+	case opBan:
+		return &BanOP{}, nil
+	}
+	return nil, errUnknownOP
+}
+
 // OP Wrapper
 type Message struct {
+	// Seq is the order the server accepted the op in, 0 for ops not yet
+	// accepted
+	Seq uint64
+	// Ref is picked by the sender and echoed back only to it when the op is
+	// accepted
+	Ref     uint32
 	Payload interface{}
 }
 
 func (m *Message) UnmarshalJSON(raw []byte) error {
 	v := struct {
 		OP      uint
+		Seq     uint64
+		Ref     uint32
 		Payload json.RawMessage
 	}{}
 	err := json.Unmarshal(raw, &v)
 	if err != nil {
 		return err
 	}
-	switch v.OP {
-	case opInit:
-		payload := InitOP{}
-		err = json.Unmarshal(v.Payload, &payload)
-		m.Payload = payload
-	case opLine:
-		payload := LineOP{}
-		err = json.Unmarshal(v.Payload, &payload)
-		m.Payload = payload
-	case opText:
-		payload := TextOP{}
-		err = json.Unmarshal(v.Payload, &payload)
-		m.Payload = payload
-	default:
-		return errors.New("unknown operation")
+	payload, err := opPayload(v.OP)
+	if err != nil {
+		return err
 	}
+	err = json.Unmarshal(v.Payload, payload)
+	m.Seq = v.Seq
+	m.Ref = v.Ref
+	m.Payload = reflect.ValueOf(payload).Elem().Interface()
 	return err
 }
 func (m Message) MarshalJSON() ([]byte, error) {
 	v := struct {
 		OP      uint
+		Seq     uint64 `json:",omitempty"`
+		Ref     uint32 `json:",omitempty"`
 		Payload interface{}
 	}{
+		OP:      opCode(m.Payload),
+		Seq:     m.Seq,
+		Ref:     m.Ref,
 		Payload: m.Payload,
 	}
-	switch m.Payload.(type) {
-	case InitOP:
-		v.OP = opInit
-	case LineOP:
-		v.OP = opLine
-	case TextOP:
-		v.OP = opText
-	}
 	return json.Marshal(v)
 }
 
+// SetAuthor returns a copy of op with its Author field set, ops without
+// an author are returned as is
+func SetAuthor(op interface{}, author string) interface{} {
+	v := reflect.ValueOf(op)
+	if v.Kind() != reflect.Struct {
+		return op
+	}
+	cp := reflect.New(v.Type()).Elem()
+	cp.Set(v)
+	f := cp.FieldByName("Author")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return op
+	}
+	f.SetString(author)
+	return cp.Interface()
+}
+
+// Attr identifies who drew an op and the stroke it belongs to, a stroke is
+// the unit of undo, and the Layer it is drawn on, empty for the bottom one
+type Attr struct {
+	Author string
+	Stroke int
+	Layer  string
+}
+
+func (a Attr) attr() Attr { return a }
+
+type attributed interface {
+	attr() Attr
+}
+
+func attrOf(op interface{}) Attr {
+	if a, ok := op.(attributed); ok {
+		return a.attr()
+	}
+	return Attr{}
+}
+
 // This ops will be marshalled with the wrapper struct
+//
+// InitOP resets the canvas to blank Layers, from bottom to top, or to a
+// single DefaultLayer if empty, the canvas has no size and grows in chunks
+// as it is drawn on
 type InitOP struct {
-	Width, Height int
-	Data          []byte
+	Layers []LayerInfo
 }
 
 type LineOP struct {
+	Attr
 	Color  color.RGBA
 	Width  float64
 	X1, Y1 float64
 	X2, Y2 float64
 }
 
+// TextOP draws a block of Text with the Font family and Style (i.e.
+// "bold"), empty means DefaultFont and DefaultStyle, every painter drawing
+// it must have the font in its FontCache.
+//
+// X, Y is the baseline of the first line, lines break at newlines and at
+// spaces past Wrap if not zero, Align places them within Wrap or the widest
+// line. With Edit the op replaces the last TextOP of the same author and
+// stroke if the painter history still has it.
 type TextOP struct {
+	Attr
 	Color color.RGBA
 	Size  float64
 	X, Y  float64
 	Text  string
+	Font  string
+	Style string
+	Wrap  float64
+	Align uint8
+	Edit  bool
+}
+
+// TileOP carries a deflate compressed rectangle of RGBA pixels of a Layer,
+// a tile without Data clears the rectangle
+type TileOP struct {
+	Layer         string
+	X, Y          int
+	Width, Height int
+	Data          []byte
+}
+
+// UndoOP removes the last stroke of Author
+type UndoOP struct {
+	Author string
+}
+
+// RedoOP restores the last stroke undone by Author
+type RedoOP struct {
+	Author string
+}
+
+type Point struct {
+	X, Y float64
+}
+
+// RectOP strokes the rectangle between two corners or fills it if Fill is
+// set
+type RectOP struct {
+	Attr
+	Color  color.RGBA
+	Width  float64
+	Fill   bool
+	X1, Y1 float64
+	X2, Y2 float64
+}
+
+// EllipseOP strokes or fills an ellipse centered at X, Y
+type EllipseOP struct {
+	Attr
+	Color  color.RGBA
+	Width  float64
+	Fill   bool
+	X, Y   float64
+	RX, RY float64
+}
+
+// PolylineOP strokes a whole path in one op
+type PolylineOP struct {
+	Attr
+	Color  color.RGBA
+	Width  float64
+	Points []Point
+}
+
+// FloodFillOP fills the area connected to X, Y whose colors are within
+// Tolerance of the color at X, Y in every channel
+type FloodFillOP struct {
+	Attr
+	Color     color.RGBA
+	X, Y      int
+	Tolerance uint8
+}
+
+// ErrorOP is sent by the server when it refuses a message, the envelope Ref
+// is the one of the refused message
+type ErrorOP struct {
+	Reason string
+}
+
+func (e ErrorOP) Error() string { return e.Reason }
+
+// LayerOP adds the named layer or updates it if it exists and moves it to
+// position At from the bottom, with Delete the layer is removed
+type LayerOP struct {
+	LayerInfo
+	At     int
+	Delete bool
+}
+
+// BrushOP paints Points with a Brush, see Brush
+type BrushOP struct {
+	Attr
+	Color  color.RGBA
+	Brush  Brush
+	Points []BrushPoint
+}
+
+// ImageOP draws an encoded PNG or JPEG image with its top left corner at
+// X, Y, scaled by Scale and rotated by Rotation radians around its center
+type ImageOP struct {
+	Attr
+	Data     []byte
+	X, Y     float64
+	Scale    float64
+	Rotation float64
+}
+
+// ViewOP subscribes the sender to the Width x Height chunks starting at
+// chunk X, Y, the server answers with their tiles and from then on only
+// sends what is drawn on them, an empty view subscribes to nothing
+type ViewOP struct {
+	X, Y          int
+	Width, Height int
+}
+
+// Roles of a connection in a room, each allows what the previous ones do
+const (
+	// RoleView only sees the canvas and the other users
+	RoleView uint8 = iota + 1
+	// RoleDraw also draws
+	RoleDraw
+	// RoleAdmin also clears the canvas and kicks users
+	RoleAdmin
+)
+
+// PresenceOP is sent by the server when a user joins a room and with Left
+// when it leaves, Author is the id on its ops and cursor, Self marks the
+// presence of the client receiving it, which carries its Role
+type PresenceOP struct {
+	Author string
+	Name   string
+	Color  color.RGBA
+	Left   bool
+	Self   bool
+	Role   uint8
+}
+
+// CursorOP is the canvas position of the pointer of Author, the server
+// relays it to the other clients at a throttled rate and doesn't keep it
+type CursorOP struct {
+	Author string
+	X, Y   float64
+}
+
+// ClearOP asks the server to blank every layer, it is answered with an
+// InitOP to everyone
+type ClearOP struct{}
+
+// KickOP asks the server to disconnect the user with the Target id
+type KickOP struct {
+	Target string
+}
+
+// ClearRectOP makes the Width x Height rectangle at X, Y transparent on
+// every layer, unlike ClearOP it is drawn and undone like other ops
+type ClearRectOP struct {
+	Attr
+	X, Y          int
+	Width, Height int
+}
+
+// EraseOP asks the server to remove every op of the Target user drawn since
+// the Since unix time, as far back as its history goes
+type EraseOP struct {
+	Target string
+	Since  int64
+}
+
+// BanOP asks the server to disconnect the Target user and refuse its
+// address in the room from then on
+type BanOP struct {
+	Target string
 }
@@ -4,35 +4,48 @@
 package painter
 
 import (
-	"encoding/json"
 	"errors"
 	"image"
+	"image/color"
+	"math"
+	"time"
 
-	"github.com/golang/freetype/truetype"
 	"github.com/llgcode/draw2d"
 	"github.com/llgcode/draw2d/draw2dimg"
-	"github.com/stdiopt/gowasm-experiments/arty/painter/font"
+	"github.com/llgcode/draw2d/draw2dkit"
 )
 
 type BufPainter struct {
-	image    *image.RGBA
-	ctx      *draw2dimg.GraphicContext
-	font     *truetype.Font
-	fontData draw2d.FontData
+	// canvas is the composite of the layers
+	canvas chunks
+	// dirty are the areas of canvas changed, see Dirty
+	dirty []image.Rectangle
+	// ctx is only used to measure text
+	ctx     *draw2dimg.GraphicContext
+	layers  []*layer
+	history *history
+	// Fonts available to TextOPs, starts with the embedded DefaultFont
+	Fonts FontCache
+	// Textures available to BrushOPs, starts with the builtin ones
+	Textures Textures
 	OnInit   func(InitOP)
+	// OnDraw is called with the area changed by each op HandleOP draws
+	OnDraw func(image.Rectangle)
+	// OnRebuild is called with the area redrawn by Undo or Redo
+	OnRebuild func(image.Rectangle)
 }
 
 func New() (*BufPainter, error) {
-	font, err := truetype.Parse(font.Data["font.ttf"])
+	fonts, err := NewFontCache()
 	if err != nil {
 		return nil, err
 	}
-	return &BufPainter{font: font}, nil
+	return &BufPainter{Fonts: fonts, Textures: NewTextures()}, nil
 }
 
+// HandleRaw decodes a JSON or binary message and handles its operation
 func (p *BufPainter) HandleRaw(msg []byte) error {
-	m := Message{}
-	err := json.Unmarshal(msg, &m)
+	m, err := Decode(msg)
 	if err != nil {
 		return err
 	}
@@ -40,63 +53,186 @@ func (p *BufPainter) HandleRaw(msg []byte) error {
 }
 
 func (p *BufPainter) HandleOP(op interface{}) error {
+	return p.HandleOPAt(op, time.Now())
+}
+
+// HandleOPAt handles op as drawn at t, the time history keeps for
+// EraseAuthor, i.e. when replaying stored ops
+func (p *BufPainter) HandleOPAt(op interface{}, t time.Time) error {
 	switch o := op.(type) {
 	case InitOP:
 		p.Init(o)
-	case LineOP:
-		p.Line(o)
+		return nil
+	case UndoOP:
+		p.Undo(o.Author)
+		return nil
+	case RedoOP:
+		p.Redo(o.Author)
+		return nil
 	case TextOP:
-		p.Text(o)
-	default:
-		return errors.New("unknown op")
+		if o.Edit {
+			if ok, err := p.EditText(o); ok || err != nil {
+				return err
+			}
+		}
+	}
+	p.history.checkpoint(p.layers)
+	r, err := p.draw(op)
+	if err != nil {
+		return err
+	}
+	p.history.record(op, r, t)
+	if p.OnDraw != nil {
+		p.OnDraw(r)
 	}
 	return nil
 }
 
-func (p *BufPainter) Set(buf []byte) {
-	if buf == nil {
-		return
+// draw paints a drawing op on its layer without recording it, updates the
+// composite and returns the area it affected
+func (p *BufPainter) draw(op interface{}) (image.Rectangle, error) {
+	if a, ok := op.(attributed); ok && p.layer(a.attr().Layer) == nil {
+		return image.Rectangle{}, errUnknownLayer
+	}
+	r := p.bounds(op)
+	if _, ok := op.(LayerOP); !ok && (r.Dx() > MaxOpSize || r.Dy() > MaxOpSize) {
+		return image.Rectangle{}, errOpTooLarge
 	}
-	copy(p.image.Pix, buf)
+	switch o := op.(type) {
+	case LineOP:
+		p.Line(o)
+	case TextOP:
+		if err := p.Text(o); err != nil {
+			return image.Rectangle{}, err
+		}
+	case TileOP:
+		if err := p.Tile(o); err != nil {
+			return image.Rectangle{}, err
+		}
+	case RectOP:
+		p.Rect(o)
+	case EllipseOP:
+		p.Ellipse(o)
+	case PolylineOP:
+		p.Polyline(o)
+	case FloodFillOP:
+		r = p.FloodFill(o)
+	case BrushOP:
+		if err := p.Brush(o); err != nil {
+			return image.Rectangle{}, err
+		}
+	case LayerOP:
+		if err := p.Layer(o); err != nil {
+			return image.Rectangle{}, err
+		}
+	case ImageOP:
+		if err := p.Image(o); err != nil {
+			return image.Rectangle{}, err
+		}
+	case ClearRectOP:
+		p.ClearRect(o)
+	default:
+		return image.Rectangle{}, errors.New("unknown op")
+	}
+	p.composite(r)
+	return r, nil
 }
 
-func (p *BufPainter) ImageData() []byte {
-	if p.image == nil {
-		return nil
+// bounds returns the canvas area affected by a drawing op, the area a
+// FloodFillOP may fill
+func (p *BufPainter) bounds(op interface{}) image.Rectangle {
+	var r image.Rectangle
+	switch o := op.(type) {
+	case LineOP:
+		r = pointsRect([]Point{{o.X1, o.Y1}, {o.X2, o.Y2}}, o.Width/2+2)
+	case TextOP:
+		r = p.textBounds(o)
+	case TileOP:
+		r = image.Rect(o.X, o.Y, o.X+o.Width, o.Y+o.Height)
+	case RectOP:
+		r = pointsRect([]Point{{o.X1, o.Y1}, {o.X2, o.Y2}}, o.Width/2+2)
+	case EllipseOP:
+		r = pointsRect([]Point{{o.X - o.RX, o.Y - o.RY}, {o.X + o.RX, o.Y + o.RY}}, o.Width/2+2)
+	case PolylineOP:
+		r = pointsRect(o.Points, o.Width/2+2)
+	case BrushOP:
+		pts := make([]Point, len(o.Points))
+		for i, pt := range o.Points {
+			pts[i] = Point{pt.X, pt.Y}
+		}
+		r = pointsRect(pts, o.Brush.Size/2+2)
+	case ImageOP:
+		r = imageBounds(o)
+	case FloodFillOP:
+		r = p.fillArea(o)
+	case ClearRectOP:
+		r = image.Rect(o.X, o.Y, o.X+o.Width, o.Y+o.Height).Intersect(p.layersExtent())
+	default:
+		r = p.layersExtent()
 	}
-	return p.image.Pix
+	return r
 }
 
-func (p *BufPainter) Width() int {
-	return p.image.Bounds().Max.X
+// pointsRect returns the rectangle containing pts grown by pad
+func pointsRect(pts []Point, pad float64) image.Rectangle {
+	if len(pts) == 0 {
+		return image.Rectangle{}
+	}
+	x0, y0, x1, y1 := pts[0].X, pts[0].Y, pts[0].X, pts[0].Y
+	for _, pt := range pts[1:] {
+		x0, y0 = math.Min(x0, pt.X), math.Min(y0, pt.Y)
+		x1, y1 = math.Max(x1, pt.X), math.Max(y1, pt.Y)
+	}
+	return rectF(x0-pad, y0-pad, x1+pad, y1+pad)
 }
 
-func (p *BufPainter) Height() int {
-	return p.image.Bounds().Max.Y
+func rectF(x0, y0, x1, y1 float64) image.Rectangle {
+	return image.Rect(
+		int(math.Floor(x0)), int(math.Floor(y0)),
+		int(math.Ceil(x1)), int(math.Ceil(y1)),
+	)
 }
 
 func (p *BufPainter) Init(op InitOP) {
-	p.image = image.NewRGBA(image.Rect(0, 0, op.Width, op.Height))
+	p.markDirty(p.canvas.extent())
+	p.canvas = chunks{}
+	p.ctx = draw2dimg.NewGraphicContext(image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	p.ctx.FontCache = p.Fonts
 
-	// init font
-	fontData := draw2d.FontData{
-		Name:   "roboto",
-		Family: draw2d.FontFamilySans,
-		Style:  draw2d.FontStyleNormal,
+	infos := op.Layers
+	if len(infos) == 0 {
+		infos = []LayerInfo{{Name: DefaultLayer, Opacity: 255}}
+	}
+	p.layers = nil
+	for _, info := range infos {
+		p.layers = append(p.layers, p.newLayer(info))
+	}
+	if p.history != nil {
+		p.history.reset(p.layers)
 	}
-	fontCache := &FontCache{}
-	fontCache.Store(fontData, p.font)
-
-	p.ctx = draw2dimg.NewGraphicContext(p.image)
-	p.ctx.FontCache = fontCache
-
-	p.Set(op.Data) // Image
 	if p.OnInit != nil {
 		p.OnInit(op)
 	}
 }
+
+// Line and the other drawing methods paint on the op layer without
+// updating the composite, HandleOP does both
 func (p *BufPainter) Line(op LineOP) {
-	c := p.ctx
+	p.paintOver(op.Layer, p.bounds(op), op.drawOn)
+}
+func (p *BufPainter) Rect(op RectOP) {
+	p.paintOver(op.Layer, p.bounds(op), op.drawOn)
+}
+func (p *BufPainter) Ellipse(op EllipseOP) {
+	p.paintOver(op.Layer, p.bounds(op), op.drawOn)
+}
+func (p *BufPainter) Polyline(op PolylineOP) {
+	p.paintOver(op.Layer, p.bounds(op), op.drawOn)
+}
+
+// drawOn and the other op methods draw a vector op on any draw2d context,
+// the layer scratch image or a vector document
+func (op LineOP) drawOn(c draw2d.GraphicContext) {
 	c.SetStrokeColor(op.Color)
 	c.SetLineWidth(op.Width)
 	c.BeginPath()
@@ -104,10 +240,41 @@ func (p *BufPainter) Line(op LineOP) {
 	c.LineTo(op.X2, op.Y2)
 	c.Stroke()
 }
-func (p *BufPainter) Text(op TextOP) {
-	c := p.ctx
-	c.SetFillColor(op.Color)
-	c.SetFont(p.font)
-	c.SetFontSize(op.Size)
-	c.FillStringAt(op.Text, op.X, op.Y)
+func (op RectOP) drawOn(c draw2d.GraphicContext) {
+	c.BeginPath()
+	draw2dkit.Rectangle(c, op.X1, op.Y1, op.X2, op.Y2)
+	paint(c, op.Color, op.Width, op.Fill)
+}
+func (op EllipseOP) drawOn(c draw2d.GraphicContext) {
+	c.BeginPath()
+	draw2dkit.Ellipse(c, op.X, op.Y, op.RX, op.RY)
+	paint(c, op.Color, op.Width, op.Fill)
+}
+func (op PolylineOP) drawOn(c draw2d.GraphicContext) {
+	if len(op.Points) == 0 {
+		return
+	}
+	c.SetStrokeColor(op.Color)
+	c.SetLineWidth(op.Width)
+	c.BeginPath()
+	c.MoveTo(op.Points[0].X, op.Points[0].Y)
+	if len(op.Points) == 1 { // a dot
+		c.LineTo(op.Points[0].X, op.Points[0].Y)
+	}
+	for _, pt := range op.Points[1:] {
+		c.LineTo(pt.X, pt.Y)
+	}
+	c.Stroke()
+}
+
+// paint fills or strokes the current path of c
+func paint(c draw2d.GraphicContext, col color.RGBA, width float64, fill bool) {
+	if fill {
+		c.SetFillColor(col)
+		c.Fill()
+		return
+	}
+	c.SetStrokeColor(col)
+	c.SetLineWidth(width)
+	c.Stroke()
 }
@@ -0,0 +1,47 @@
+package painter
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Record is a timestamped message of a recording
+type Record struct {
+	Time    time.Time
+	Message Message
+}
+
+// Recorder writes timestamped messages to w as JSON lines
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Record writes m stamped with the current time
+func (r *Recorder) Record(m Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(Record{Time: time.Now(), Message: m})
+}
+
+// RecordReader reads the records written by a Recorder
+type RecordReader struct {
+	dec *json.Decoder
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next record or io.EOF at the end of the recording
+func (r *RecordReader) Next() (Record, error) {
+	rec := Record{}
+	err := r.dec.Decode(&rec)
+	return rec, err
+}
@@ -0,0 +1,122 @@
+package painter
+
+import "image"
+
+// Replica keeps a client copy of a canvas in the order the server accepted
+// the ops. Local ops are drawn on View right away and kept pending until the
+// server echoes them back, if other ops got in between View is rebuilt from
+// Base with the pending ops on top.
+type Replica struct {
+	// Base holds only ops accepted by the server
+	Base *BufPainter
+	// View is Base plus the pending local ops
+	View *BufPainter
+
+	pending []Message
+	nextRef uint32
+	// View needs a rebuild
+	stale bool
+}
+
+func NewReplica() (*Replica, error) {
+	base, err := New()
+	if err != nil {
+		return nil, err
+	}
+	view, err := New()
+	if err != nil {
+		return nil, err
+	}
+	return &Replica{Base: base, View: view}, nil
+}
+
+// Local draws op on View and returns the message to send to the server
+func (r *Replica) Local(op interface{}) Message {
+	r.nextRef++
+	m := Message{Ref: r.nextRef, Payload: op}
+	r.pending = append(r.pending, m)
+	r.View.HandleOP(op)
+	return m
+}
+
+// Remote handles a message from the server, an ErrorOP drops the refused
+// pending op and is returned as the error
+func (r *Replica) Remote(m Message) error {
+	switch o := m.Payload.(type) {
+	case InitOP:
+		r.pending = nil
+		r.stale = false
+		r.Base.Init(o)
+		r.View.Init(o)
+		return nil
+	case ErrorOP:
+		r.Reject(m.Ref)
+		return o
+	}
+	err := r.Base.HandleOP(m.Payload)
+	switch {
+	case m.Ref != 0:
+		r.ack(m.Ref)
+	case len(r.pending) == 0 && !r.stale:
+		// Nothing optimistic on View, it matches Base
+		r.View.HandleOP(m.Payload)
+	default:
+		r.stale = true
+	}
+	return err
+}
+
+// Reject drops a pending op the server refused
+func (r *Replica) Reject(ref uint32) {
+	for i, m := range r.pending {
+		if m.Ref == ref {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			r.stale = true
+			return
+		}
+	}
+}
+
+// ack removes an accepted op from pending, View stays valid only if it was
+// the oldest one
+func (r *Replica) ack(ref uint32) {
+	for i, m := range r.pending {
+		if m.Ref != ref {
+			continue
+		}
+		if i != 0 {
+			r.stale = true
+		}
+		r.pending = append(r.pending[:i], r.pending[i+1:]...)
+		return
+	}
+	// Not ours anymore, make sure View catches up
+	r.stale = true
+}
+
+// Invalidate makes the next Sync rebuild View, i.e. after a preview was
+// drawn directly on it
+func (r *Replica) Invalidate() {
+	r.stale = true
+}
+
+// Retain drops the chunks outside the cr chunk range, see BufPainter.Retain,
+// View is rebuilt on the next Sync
+func (r *Replica) Retain(cr image.Rectangle) {
+	r.Base.Retain(cr)
+	r.stale = true
+}
+
+// Sync rebuilds View if needed and reports whether it did, anything drawn
+// directly on View is lost on a rebuild
+func (r *Replica) Sync() bool {
+	if !r.stale {
+		return false
+	}
+	r.View.Copy(r.Base)
+	for _, m := range r.pending {
+		r.View.HandleOP(m.Payload)
+	}
+	r.stale = false
+	return true
+}
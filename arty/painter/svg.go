@@ -0,0 +1,459 @@
+package painter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/llgcode/draw2d"
+	"github.com/llgcode/draw2d/draw2dsvg"
+)
+
+// SVG replays ops like a BufPainter and keeps them as a vector document,
+// lines and shapes become paths, text becomes text elements in the op font
+// family and the other ops images of the pixels they changed. The whole
+// history is needed to keep the vectors, the server -record recordings have
+// it while a room ops.log starts from the tiles of its last snapshot. Ops that replace pixels, tiles, erasers and cleared
+// areas, mask out what was drawn there before, so vectors only partly
+// covered by them are kept and the rest is in the images. Undo and redo
+// hide and show what a stroke drew, fills drawn after it keep the area
+// they had.
+type SVG struct {
+	p *BufPainter
+	// items of each layer by name, bottom to top
+	items map[string][]*svgItem
+	masks []*svgMask
+	// replaced are the strokes that replaced pixels, undoing them redraws
+	// the area as an image
+	replaced map[strokeKey]bool
+	// rebuilt is the area redrawn by undo, redo or a text edit
+	rebuilt image.Rectangle
+}
+
+type strokeKey struct {
+	author string
+	stroke int
+}
+
+// svgItem is what an op drew on a layer
+type svgItem struct {
+	stroke strokeKey
+	bounds image.Rectangle
+	g      *draw2dsvg.Group
+	text   bool
+	undone bool
+}
+
+// NewSVG returns a blank document, fonts replaces the embedded font cache
+// if not nil
+func NewSVG(fonts FontCache) (*SVG, error) {
+	p, err := New()
+	if err != nil {
+		return nil, err
+	}
+	if fonts != nil {
+		p.Fonts = fonts
+	}
+	s := &SVG{p: p}
+	p.OnInit = func(InitOP) {
+		s.items = map[string][]*svgItem{}
+		s.masks = nil
+		s.replaced = map[strokeKey]bool{}
+	}
+	p.OnRebuild = func(r image.Rectangle) {
+		s.rebuilt = s.rebuilt.Union(r)
+	}
+	p.EnableHistory()
+	p.Init(InitOP{})
+	return s, nil
+}
+
+// HandleOP draws op on the document
+func (s *SVG) HandleOP(op interface{}) error {
+	p := s.p
+	g, err := s.vector(op)
+	if err != nil {
+		return err
+	}
+	a := attrOf(op)
+	key := strokeKey{a.Author, a.Stroke}
+	name := a.Layer
+	if t, ok := op.(TileOP); ok {
+		name = t.Layer
+	}
+	if l := p.layer(name); l != nil {
+		name = l.Name
+	}
+	r := p.bounds(op)
+	// The stroke undo or redo will mark, as the painter picks it
+	var toggle *strokeKey
+	var before *image.RGBA
+	switch o := op.(type) {
+	case UndoOP:
+		if stroke, ok := p.history.lastStroke(o.Author); ok {
+			toggle = &strokeKey{o.Author, stroke}
+		}
+	case RedoOP:
+		if stack := p.history.redo[o.Author]; len(stack) > 0 {
+			toggle = &strokeKey{o.Author, stack[len(stack)-1]}
+		}
+	case ImageOP, FloodFillOP:
+		// Ops painting over the layer keep what was there to tell what
+		// they changed
+		before = p.LayerRegion(name, r)
+	case BrushOP:
+		if !o.Brush.Eraser {
+			before = p.LayerRegion(name, r)
+		}
+	}
+
+	s.rebuilt = image.Rectangle{}
+	if err := p.HandleOP(op); err != nil {
+		return err
+	}
+	if !s.rebuilt.Empty() {
+		_, undo := op.(UndoOP)
+		switch {
+		case toggle != nil && !s.replaced[*toggle]:
+			s.each(func(it *svgItem) {
+				if it.stroke == *toggle {
+					it.undone = undo
+				}
+			})
+		case g != nil && s.edit(key, r, g):
+		default:
+			for _, l := range p.layers {
+				s.replace(key, l.Name, s.rebuilt)
+			}
+		}
+		return nil
+	}
+	switch o := op.(type) {
+	case LayerOP:
+		if o.Delete {
+			delete(s.items, o.Name)
+		}
+	case TileOP:
+		s.replace(key, name, r)
+	case ClearRectOP:
+		for _, l := range p.layers {
+			s.replace(key, l.Name, r)
+		}
+	case BrushOP:
+		if o.Brush.Eraser {
+			s.replace(key, name, r)
+			break
+		}
+		s.drawChanged(key, name, before)
+	default:
+		if g != nil {
+			_, text := op.(TextOP)
+			s.items[name] = append(s.items[name], &svgItem{
+				stroke: key,
+				bounds: r,
+				g:      g,
+				text:   text,
+			})
+		} else if before != nil {
+			s.drawChanged(key, name, before)
+		}
+	}
+	return nil
+}
+
+// vector returns the group drawing a line, shape or text op, nil for the
+// ops drawn otherwise
+func (s *SVG) vector(op interface{}) (*draw2dsvg.Group, error) {
+	switch o := op.(type) {
+	case LineOP:
+		return s.group(o.drawOn), nil
+	case RectOP:
+		return s.group(o.drawOn), nil
+	case EllipseOP:
+		return s.group(o.drawOn), nil
+	case PolylineOP:
+		return s.group(o.drawOn), nil
+	case TextOP:
+		return s.text(o)
+	}
+	return nil, nil
+}
+
+// text returns a text element for each line of the op block, placed as the
+// painter lays them out
+func (s *SVG) text(op TextOP) (*draw2dsvg.Group, error) {
+	font, err := s.p.Fonts.Font(op.Font, op.Style)
+	if err != nil {
+		return nil, err
+	}
+	family := op.Font
+	if family == "" {
+		family = DefaultFont
+	}
+	style := []string{"white-space:pre"}
+	lower := strings.ToLower(op.Style)
+	if strings.Contains(lower, "bold") {
+		style = append(style, "font-weight:bold")
+	}
+	if strings.Contains(lower, "italic") || strings.Contains(lower, "oblique") {
+		style = append(style, "font-style:italic")
+	}
+	g := &draw2dsvg.Group{}
+	for _, l := range s.p.layout(op, font) {
+		if l.text == "" {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		xml.EscapeText(buf, []byte(l.text))
+		t := &draw2dsvg.Text{
+			FontSize:   op.Size * float64(s.p.ctx.GetDPI()) / 72,
+			FontFamily: family,
+			Text:       buf.String(),
+			Style:      strings.Join(style, ";"),
+		}
+		t.X, t.Y = l.x, l.y
+		t.Fill = svgColor(op.Color)
+		g.Texts = append(g.Texts, t)
+	}
+	return g, nil
+}
+
+// svgColor returns c as an SVG paint like draw2dsvg does
+func svgColor(c color.RGBA) string {
+	if c.A == 255 {
+		return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("rgba(%d,%d,%d,%g)", c.R, c.G, c.B, float64(c.A)/255)
+}
+
+// group returns what fn draws as a group
+func (s *SVG) group(fn func(c draw2d.GraphicContext)) *draw2dsvg.Group {
+	doc := draw2dsvg.NewSvg()
+	c := draw2dsvg.NewGraphicContext(doc)
+	c.FontCache = s.p.Fonts
+	fn(c)
+	return &draw2dsvg.Group{Groups: doc.Groups}
+}
+
+// each calls fn with every item
+func (s *SVG) each(fn func(it *svgItem)) {
+	for _, items := range s.items {
+		for _, it := range items {
+			fn(it)
+		}
+	}
+}
+
+// edit replaces the last text of stroke with g, covering r, it reports
+// false if the text is gone or was partly replaced
+func (s *SVG) edit(stroke strokeKey, r image.Rectangle, g *draw2dsvg.Group) bool {
+	var text *svgItem
+	s.each(func(it *svgItem) {
+		if it.stroke == stroke && it.text && !it.undone {
+			text = it
+		}
+	})
+	if text == nil || text.g.Mask != "" {
+		return false
+	}
+	text.bounds = r
+	text.g = g
+	return true
+}
+
+// addImage appends img as an item of the named layer, blank images are
+// skipped
+func (s *SVG) addImage(stroke strokeKey, name string, img *image.RGBA) {
+	r := img.Bounds()
+	if r.Empty() || isBlank(img, r) {
+		return
+	}
+	buf := &bytes.Buffer{}
+	png.Encode(buf, img)
+	svgImg := &draw2dsvg.Image{Href: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())}
+	svgImg.X, svgImg.Y = float64(r.Min.X), float64(r.Min.Y)
+	svgImg.Width, svgImg.Height = fmt.Sprint(r.Dx()), fmt.Sprint(r.Dy())
+	s.items[name] = append(s.items[name], &svgItem{
+		stroke: stroke,
+		bounds: r,
+		g:      &draw2dsvg.Group{Image: svgImg},
+	})
+}
+
+// drawChanged appends the pixels of the named layer that differ from
+// before as an image
+func (s *SVG) drawChanged(stroke strokeKey, name string, before *image.RGBA) {
+	after := s.p.LayerRegion(name, before.Bounds())
+	for i := 0; i < len(after.Pix); i += 4 {
+		px := after.Pix[i : i+4]
+		if bytes.Equal(px, before.Pix[i:i+4]) {
+			px[0], px[1], px[2], px[3] = 0, 0, 0, 0
+		}
+	}
+	s.addImage(stroke, name, after)
+}
+
+// replace makes r on the named layer an image of its pixels, the items
+// within r are dropped and the ones partly in it masked
+func (s *SVG) replace(stroke strokeKey, name string, r image.Rectangle) {
+	if r.Empty() {
+		return
+	}
+	if stroke.author != "" {
+		s.replaced[stroke] = true
+	}
+	items := []*svgItem{}
+	masked := []*svgItem{}
+	area := image.Rectangle{}
+	for _, it := range s.items[name] {
+		switch {
+		case !it.bounds.Overlaps(r):
+		case it.bounds.In(r):
+			continue
+		default:
+			masked = append(masked, it)
+			area = area.Union(it.bounds)
+		}
+		items = append(items, it)
+	}
+	if len(masked) > 0 {
+		m := newSVGMask(fmt.Sprintf("mask-%d", len(s.masks)+1), area, r)
+		s.masks = append(s.masks, m)
+		for _, it := range masked {
+			it.g = &draw2dsvg.Group{
+				Groups: []*draw2dsvg.Group{it.g},
+				Mask:   "url(#" + m.ID + ")",
+			}
+		}
+	}
+	s.items[name] = items
+	s.addImage(stroke, name, s.p.LayerRegion(name, r))
+}
+
+// Extent returns the area covered by the items of the visible layers
+func (s *SVG) Extent() image.Rectangle {
+	r := image.Rectangle{}
+	for _, l := range s.p.layers {
+		if l.Hidden {
+			continue
+		}
+		for _, it := range s.items[l.Name] {
+			if !it.undone {
+				r = r.Union(it.bounds)
+			}
+		}
+	}
+	return r
+}
+
+// Encode writes the document showing r, or the Extent if r is empty, at
+// scale pixels per canvas pixel, layers are groups Inkscape sees as layers
+func (s *SVG) Encode(w io.Writer, r image.Rectangle, scale float64) error {
+	if r.Empty() {
+		r = s.Extent()
+	}
+	if r.Empty() {
+		r = image.Rect(0, 0, 1, 1)
+	}
+	doc := svgDoc{
+		Xmlns:    "http://www.w3.org/2000/svg",
+		Inkscape: "http://www.inkscape.org/namespaces/inkscape",
+		Width:    fmt.Sprint(float64(r.Dx()) * scale),
+		Height:   fmt.Sprint(float64(r.Dy()) * scale),
+		ViewBox:  fmt.Sprintf("%d %d %d %d", r.Min.X, r.Min.Y, r.Dx(), r.Dy()),
+		Fill:     "none",
+		Stroke:   "none",
+		Masks:    s.masks,
+	}
+	for _, l := range s.p.layers {
+		sl := svgLayer{Mode: "layer", Label: l.Name}
+		if l.Opacity < 255 {
+			sl.Opacity = fmt.Sprint(float64(l.Opacity) / 255)
+		}
+		if l.Hidden {
+			sl.Display = "none"
+		}
+		switch l.Blend {
+		case BlendMultiply:
+			sl.Style = "mix-blend-mode:multiply"
+		case BlendScreen:
+			sl.Style = "mix-blend-mode:screen"
+		case BlendAdd:
+			sl.Style = "mix-blend-mode:plus-lighter"
+		}
+		for _, it := range s.items[l.Name] {
+			if !it.undone {
+				sl.Groups = append(sl.Groups, it.g)
+			}
+		}
+		doc.Layers = append(doc.Layers, sl)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	return enc.Encode(doc)
+}
+
+type svgDoc struct {
+	XMLName  xml.Name   `xml:"svg"`
+	Xmlns    string     `xml:"xmlns,attr"`
+	Inkscape string     `xml:"xmlns:inkscape,attr"`
+	Width    string     `xml:"width,attr"`
+	Height   string     `xml:"height,attr"`
+	ViewBox  string     `xml:"viewBox,attr"`
+	Fill     string     `xml:"fill,attr"`
+	Stroke   string     `xml:"stroke,attr"`
+	Masks    []*svgMask `xml:"defs>mask"`
+	Layers   []svgLayer `xml:"g"`
+}
+
+type svgLayer struct {
+	Mode    string             `xml:"inkscape:groupmode,attr"`
+	Label   string             `xml:"inkscape:label,attr"`
+	Opacity string             `xml:"opacity,attr,omitempty"`
+	Display string             `xml:"display,attr,omitempty"`
+	Style   string             `xml:"style,attr,omitempty"`
+	Groups  []*draw2dsvg.Group `xml:"g"`
+}
+
+// svgMask shows area except the hole, in canvas coordinates
+type svgMask struct {
+	ID     string    `xml:"id,attr"`
+	Units  string    `xml:"maskUnits,attr"`
+	X      int       `xml:"x,attr"`
+	Y      int       `xml:"y,attr"`
+	Width  int       `xml:"width,attr"`
+	Height int       `xml:"height,attr"`
+	Rects  []svgRect `xml:"rect"`
+}
+
+type svgRect struct {
+	X      int    `xml:"x,attr"`
+	Y      int    `xml:"y,attr"`
+	Width  int    `xml:"width,attr"`
+	Height int    `xml:"height,attr"`
+	Fill   string `xml:"fill,attr"`
+}
+
+func newSVGMask(id string, area, hole image.Rectangle) *svgMask {
+	rect := func(r image.Rectangle, fill string) svgRect {
+		return svgRect{r.Min.X, r.Min.Y, r.Dx(), r.Dy(), fill}
+	}
+	return &svgMask{
+		ID:     id,
+		Units:  "userSpaceOnUse",
+		X:      area.Min.X,
+		Y:      area.Min.Y,
+		Width:  area.Dx(),
+		Height: area.Dy(),
+		Rects:  []svgRect{rect(area, "#fff"), rect(hole, "#000")},
+	}
+}
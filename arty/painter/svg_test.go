@@ -0,0 +1,121 @@
+package painter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// svgNode is any element of an encoded document
+type svgNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Text    string     `xml:",chardata"`
+	Nodes   []svgNode  `xml:",any"`
+}
+
+func (n svgNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// find returns the elements named name within n
+func (n svgNode) find(name string) []svgNode {
+	ret := []svgNode{}
+	for _, c := range n.Nodes {
+		if c.XMLName.Local == name {
+			ret = append(ret, c)
+		}
+		ret = append(ret, c.find(name)...)
+	}
+	return ret
+}
+
+// testSVG draws ops on a new document and returns it parsed
+func testSVG(t *testing.T, ops ...interface{}) svgNode {
+	s, err := NewSVG(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, op := range ops {
+		if err := s.HandleOP(op); err != nil {
+			t.Fatalf("op %d %T: %v", i, op, err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := s.Encode(buf, image.Rectangle{}, 2); err != nil {
+		t.Fatal(err)
+	}
+	doc := svgNode{}
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("%v\n%s", err, buf)
+	}
+	return doc
+}
+
+func TestSVGShapes(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	a := Attr{Author: "a", Stroke: 1}
+	doc := testSVG(t,
+		LineOP{Attr: a, Color: red, Width: 3, X1: 10, Y1: 10, X2: 120, Y2: 80},
+		RectOP{Attr: Attr{Author: "a", Stroke: 2}, Color: red, Fill: true, X1: 130, Y1: 10, X2: 160, Y2: 40},
+	)
+	if n := len(doc.find("path")); n != 2 {
+		t.Errorf("%d paths, want 2", n)
+	}
+	for _, name := range []string{"image", "text"} {
+		if n := len(doc.find(name)); n != 0 {
+			t.Errorf("%d %s elements for a line and a rect", n, name)
+		}
+	}
+
+	doc = testSVG(t,
+		LineOP{Attr: a, Color: red, Width: 3, X1: 10, Y1: 10, X2: 120, Y2: 80},
+		UndoOP{Author: "a"},
+	)
+	if n := len(doc.find("path")); n != 0 {
+		t.Errorf("%d paths after undo", n)
+	}
+}
+
+func TestSVGText(t *testing.T) {
+	a := Attr{Author: "a", Stroke: 1}
+	text := TextOP{Attr: a, Color: color.RGBA{255, 0, 0, 255}, Size: 16, X: 10, Y: 50, Text: "a < b & c\nsecond"}
+	doc := testSVG(t, text)
+	if n := len(doc.find("path")); n != 0 {
+		t.Errorf("text drawn as %d paths", n)
+	}
+	texts := doc.find("text")
+	if len(texts) != 2 {
+		t.Fatalf("%d text elements, want 2", len(texts))
+	}
+	for i, want := range []string{"a < b & c", "second"} {
+		tx := texts[i]
+		if tx.Text != want {
+			t.Errorf("line %d is %q, want %q", i, tx.Text, want)
+		}
+		if f := tx.attr("font-family"); f != DefaultFont {
+			t.Errorf("line %d font %q", i, f)
+		}
+		if f := tx.attr("fill"); f != "#FF0000" {
+			t.Errorf("line %d fill %q", i, f)
+		}
+	}
+	if y0, y1 := texts[0].attr("y"), texts[1].attr("y"); y0 != "50" || y1 == y0 {
+		t.Errorf("lines at y %s and %s", y0, y1)
+	}
+
+	edit := text
+	edit.Text = "edited"
+	edit.Edit = true
+	texts = testSVG(t, text, edit).find("text")
+	if len(texts) != 1 || texts[0].Text != "edited" {
+		t.Errorf("edited text is %#v", texts)
+	}
+}
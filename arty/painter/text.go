@@ -0,0 +1,171 @@
+package painter
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/golang/freetype/truetype"
+	"github.com/llgcode/draw2d"
+	"golang.org/x/image/math/fixed"
+)
+
+// Text alignment within the block, see TextOP
+const (
+	AlignLeft uint8 = iota
+	AlignCenter
+	AlignRight
+)
+
+// lineSpacing is the distance between baselines relative to the font size
+const lineSpacing = 1.2
+
+// textLine is a line of a text block placed on the canvas
+type textLine struct {
+	text  string
+	x, y  float64
+	width float64
+}
+
+// layout breaks op.Text in lines at newlines and, if op.Wrap is set, at
+// spaces so no line is wider than op.Wrap, a single word wider than that
+// gets a line of its own
+func (p *BufPainter) layout(op TextOP, font *truetype.Font) []textLine {
+	size := op.Size * float64(p.ctx.GetDPI()) / 72
+	scale := fixed.Int26_6(size * 64)
+
+	lines := []textLine{}
+	for _, para := range strings.Split(op.Text, "\n") {
+		line := ""
+		for i, word := range strings.Split(para, " ") {
+			next := word
+			if i > 0 {
+				next = line + " " + word
+			}
+			if op.Wrap > 0 && i > 0 && line != "" && advance(font, scale, next) > op.Wrap {
+				lines = append(lines, textLine{text: line})
+				next = word
+			}
+			line = next
+		}
+		lines = append(lines, textLine{text: line})
+	}
+
+	box := op.Wrap
+	for i := range lines {
+		lines[i].width = advance(font, scale, lines[i].text)
+		if op.Wrap <= 0 {
+			box = math.Max(box, lines[i].width)
+		}
+	}
+	for i := range lines {
+		l := &lines[i]
+		l.x = op.X
+		switch op.Align {
+		case AlignCenter:
+			l.x += (box - l.width) / 2
+		case AlignRight:
+			l.x += box - l.width
+		}
+		l.y = op.Y + float64(i)*size*lineSpacing
+	}
+	return lines
+}
+
+// advance returns the width of s as drawn by draw2d, glyph advances plus
+// kerning
+func advance(font *truetype.Font, scale fixed.Int26_6, s string) float64 {
+	w := fixed.Int26_6(0)
+	prev, hasPrev := truetype.Index(0), false
+	for _, r := range s {
+		index := font.Index(r)
+		if hasPrev {
+			w += font.Kern(scale, prev, index)
+		}
+		w += font.HMetric(scale, index).AdvanceWidth
+		prev, hasPrev = index, true
+	}
+	return float64(w) / 64
+}
+
+// Text draws the op text block with its font, which must be in Fonts
+func (p *BufPainter) Text(op TextOP) error {
+	fn, err := p.textDrawing(op)
+	if err != nil {
+		return err
+	}
+	return p.paintOver(op.Layer, p.textBounds(op), fn)
+}
+
+// textDrawing returns the function drawing the op text block on a draw2d
+// context
+func (p *BufPainter) textDrawing(op TextOP) (func(c draw2d.GraphicContext), error) {
+	font, err := p.Fonts.Font(op.Font, op.Style)
+	if err != nil {
+		return nil, err
+	}
+	lines := p.layout(op, font)
+	return func(c draw2d.GraphicContext) {
+		p.setFont(c, op)
+		c.SetFillColor(op.Color)
+		for _, l := range lines {
+			c.FillStringAt(l.text, l.x, l.y)
+		}
+	}, nil
+}
+
+// textBounds returns the area covered by the op glyphs
+func (p *BufPainter) textBounds(op TextOP) image.Rectangle {
+	font, err := p.setFont(p.ctx, op)
+	if err != nil {
+		return image.Rectangle{}
+	}
+	r := image.Rectangle{}
+	for _, l := range p.layout(op, font) {
+		if l.text == "" {
+			continue
+		}
+		left, top, right, bottom := p.ctx.GetStringBounds(l.text)
+		r = r.Union(rectF(l.x+left-2, l.y+top-2, l.x+right+2, l.y+bottom+2))
+	}
+	return r
+}
+
+// setFont selects the op font and size in c, draw2d loads the font
+// through FontCache by name on every string operation
+func (p *BufPainter) setFont(c draw2d.GraphicContext, op TextOP) (*truetype.Font, error) {
+	font, err := p.Fonts.Font(op.Font, op.Style)
+	if err != nil {
+		return nil, err
+	}
+	c.SetFontData(draw2d.FontData{Name: fontKey(op.Font, op.Style)})
+	c.SetFontSize(op.Size)
+	return font, nil
+}
+
+// EditText replaces the last TextOP of the op author and stroke with op
+// and redraws the canvas from there, it reports false if history is
+// disabled or has no such text, an edit that can't be drawn is rolled back
+func (p *BufPainter) EditText(op TextOP) (bool, error) {
+	h := p.history
+	if h == nil {
+		return false, nil
+	}
+	i, ok := h.lastText(op.Author, op.Stroke)
+	if !ok {
+		return false, nil
+	}
+	if _, err := p.Fonts.Font(op.Font, op.Style); err != nil {
+		return false, err
+	}
+	e := &h.entries[i]
+	old, oldBounds := e.op, e.bounds
+	e.op, e.bounds = op, p.bounds(op)
+	r := oldBounds.Union(e.bounds)
+	if err := p.rebuild(i, r); err != nil {
+		e.op, e.bounds = old, oldBounds
+		p.rebuild(i, r)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,45 @@
+package painter
+
+import (
+	"bytes"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestEditTextRollback(t *testing.T) {
+	p := newTestPainter(t)
+	p.Init(InitOP{})
+	text := TextOP{Attr: Attr{Author: "a", Stroke: 1}, Color: color.RGBA{255, 0, 0, 255}, Size: 16, X: 10, Y: 50, Text: "hello"}
+	if err := p.HandleOP(text); err != nil {
+		t.Fatal(err)
+	}
+	r := p.Extent()
+	before := p.Region(r).Pix
+
+	bad := []TextOP{text, text}
+	bad[0].Layer = "nope"
+	bad[1].Text = strings.Repeat("wide ", 1000)
+	for _, op := range bad {
+		op.Edit = true
+		if err := p.HandleOP(op); err == nil {
+			t.Fatalf("edit to %.20q on layer %q: no error", op.Text, op.Layer)
+		}
+		if !bytes.Equal(p.Region(r).Pix, before) {
+			t.Fatalf("failed edit to %.20q changed the canvas", op.Text)
+		}
+		if got := p.history.entries[0].op; got != text {
+			t.Fatalf("failed edit kept in history: %#v", got)
+		}
+	}
+
+	edit := text
+	edit.Text = "bye"
+	edit.Edit = true
+	if err := p.HandleOP(edit); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.history.entries) != 1 || p.history.entries[0].op != edit {
+		t.Fatalf("history after edit: %#v", p.history.entries)
+	}
+}
@@ -0,0 +1,142 @@
+package painter
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+var errTileBounds = errors.New("tile out of bounds")
+
+// Tiles returns a deflate compressed tile per chunk of every layer
+func (p *BufPainter) Tiles() ([]TileOP, error) {
+	return p.ChunkTiles(ChunksIn(p.layersExtent()))
+}
+
+// ChunkTiles returns the tiles of the chunks of every layer within the cr
+// chunk range, blank chunks are skipped
+func (p *BufPainter) ChunkTiles(cr image.Rectangle) ([]TileOP, error) {
+	ret := []TileOP{}
+	for _, l := range p.layers {
+		for _, pos := range l.chunks.positions(cr) {
+			t, err := tile(l, pos.Rect())
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, t)
+		}
+	}
+	return ret, nil
+}
+
+// TilesIn splits r of every layer in tiles along the chunk edges, blank
+// tiles are returned without Data
+func (p *BufPainter) TilesIn(r image.Rectangle) ([]TileOP, error) {
+	ret := []TileOP{}
+	cr := ChunksIn(r)
+	for _, l := range p.layers {
+		for y := cr.Min.Y; y < cr.Max.Y; y++ {
+			for x := cr.Min.X; x < cr.Max.X; x++ {
+				t, err := tile(l, ChunkPos{x, y}.Rect().Intersect(r))
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, t)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// tile returns the pixels of l within r, which must be within a chunk
+func tile(l *layer, r image.Rectangle) (TileOP, error) {
+	t := TileOP{
+		Layer:  l.Name,
+		X:      r.Min.X,
+		Y:      r.Min.Y,
+		Width:  r.Dx(),
+		Height: r.Dy(),
+	}
+	img, ok := l.chunks[chunkAt(r.Min.X, r.Min.Y)]
+	if !ok || isBlank(img, r) {
+		return t, nil
+	}
+	data, err := compressRect(img, r)
+	if err != nil {
+		return TileOP{}, err
+	}
+	t.Data = data
+	return t, nil
+}
+
+// Snapshot returns the messages that recreate the current canvas, an
+// InitOP with the layers followed by their tiles
+func (p *BufPainter) Snapshot() ([]Message, error) {
+	ret := []Message{{Payload: InitOP{Layers: p.Layers()}}}
+	tiles, err := p.Tiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tiles {
+		ret = append(ret, Message{Payload: t})
+	}
+	return ret, nil
+}
+
+// Tile decompresses op pixels into its layer, a tile without Data clears
+// its area
+func (p *BufPainter) Tile(op TileOP) error {
+	l := p.layer(op.Layer)
+	if l == nil {
+		return errUnknownLayer
+	}
+	r := image.Rect(op.X, op.Y, op.X+op.Width, op.Y+op.Height)
+	if r.Empty() || r.Dx() > MaxOpSize || r.Dy() > MaxOpSize {
+		return errTileBounds
+	}
+	img := image.NewRGBA(r)
+	if len(op.Data) > 0 {
+		zr := flate.NewReader(bytes.NewReader(op.Data))
+		defer zr.Close()
+		if _, err := io.ReadFull(zr, img.Pix); err != nil {
+			return err
+		}
+	}
+	l.chunks.write(img, r, draw.Src)
+	return nil
+}
+
+func isBlank(img *image.RGBA, r image.Rectangle) bool {
+	stride := r.Dx() * 4
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := img.PixOffset(r.Min.X, y)
+		for _, b := range img.Pix[i : i+stride] {
+			if b != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func compressRect(img *image.RGBA, r image.Rectangle) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	stride := r.Dx() * 4
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := img.PixOffset(r.Min.X, y)
+		if _, err := zw.Write(img.Pix[i : i+stride]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
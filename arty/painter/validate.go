@@ -0,0 +1,214 @@
+package painter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"reflect"
+	"unicode/utf8"
+)
+
+// Limits for ops sent by clients
+const (
+	MaxLineWidth   = 200
+	MaxTextSize    = 400
+	MaxTextLen     = 1024
+	MaxPoints      = 4096
+	MaxFontName    = 64
+	MaxLayerName   = 64
+	MaxTextureName = 64
+	MaxImageBytes  = 1 << 20
+	MaxImageSize   = 4096
+	MaxImageScale  = 16
+	// MaxCoord bounds canvas coordinates in every direction
+	MaxCoord = 1 << 20
+	// MaxViewChunks is the number of chunks a client can subscribe to
+	MaxViewChunks = 512
+	MaxIDLen      = 64
+)
+
+var errForbiddenOP = errors.New("operation not allowed")
+
+// Validate checks an op sent by a client, coordinates are within MaxCoord
+// and sizes within MaxOpSize, the area an op draws is checked once drawn
+func Validate(op interface{}) error {
+	if err := checkFloats(reflect.ValueOf(op)); err != nil {
+		return err
+	}
+	if len(attrOf(op).Layer) > MaxLayerName {
+		return errors.New("invalid layer name")
+	}
+	inRange := func(x, y float64) error {
+		if math.Abs(x) > MaxCoord || math.Abs(y) > MaxCoord {
+			return fmt.Errorf("point %g,%g out of range", x, y)
+		}
+		return nil
+	}
+	width := func(v float64) error {
+		if v < 0 || v > MaxLineWidth {
+			return fmt.Errorf("width %g out of range", v)
+		}
+		return nil
+	}
+
+	switch o := op.(type) {
+	case LineOP:
+		return firstErr(width(o.Width), inRange(o.X1, o.Y1), inRange(o.X2, o.Y2))
+	case TextOP:
+		if o.Size < 0 || o.Size > MaxTextSize {
+			return fmt.Errorf("text size %g out of range", o.Size)
+		}
+		if len(o.Text) > MaxTextLen || !utf8.ValidString(o.Text) {
+			return errors.New("invalid text")
+		}
+		if len(o.Font) > MaxFontName || len(o.Style) > MaxFontName {
+			return errors.New("invalid font")
+		}
+		if o.Wrap < 0 || o.Wrap > MaxOpSize || o.Align > AlignRight {
+			return errors.New("invalid text layout")
+		}
+		return inRange(o.X, o.Y)
+	case RectOP:
+		return firstErr(width(o.Width), inRange(o.X1, o.Y1), inRange(o.X2, o.Y2))
+	case EllipseOP:
+		if o.RX < 0 || o.RX > MaxOpSize/2 || o.RY < 0 || o.RY > MaxOpSize/2 {
+			return errors.New("ellipse radius out of range")
+		}
+		return firstErr(width(o.Width), inRange(o.X, o.Y))
+	case PolylineOP:
+		if len(o.Points) == 0 || len(o.Points) > MaxPoints {
+			return fmt.Errorf("polyline with %d points", len(o.Points))
+		}
+		if err := width(o.Width); err != nil {
+			return err
+		}
+		for _, pt := range o.Points {
+			if err := inRange(pt.X, pt.Y); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FloodFillOP:
+		return inRange(float64(o.X), float64(o.Y))
+	case BrushOP:
+		b := o.Brush
+		if b.Size <= 0 || b.Size > MaxLineWidth {
+			return fmt.Errorf("brush size %g out of range", b.Size)
+		}
+		if b.Hardness < 0 || b.Hardness > 1 || b.Spacing > 10 ||
+			(b.Spacing != 0 && b.Spacing < MinBrushSpacing) {
+			return errors.New("invalid brush")
+		}
+		if len(b.Texture) > MaxTextureName {
+			return errors.New("invalid brush texture")
+		}
+		if len(o.Points) == 0 || len(o.Points) > MaxPoints {
+			return fmt.Errorf("brush stroke with %d points", len(o.Points))
+		}
+		for _, pt := range o.Points {
+			if pt.Pressure < 0 || pt.Pressure > 1 {
+				return errors.New("pressure out of range")
+			}
+			if err := inRange(pt.X, pt.Y); err != nil {
+				return err
+			}
+		}
+		if BrushWork(o) > MaxBrushWork {
+			return errors.New("brush stroke too long")
+		}
+		return nil
+	case ImageOP:
+		if len(o.Data) > MaxImageBytes {
+			return fmt.Errorf("image of %d bytes is too large", len(o.Data))
+		}
+		// Only the header is decoded here, the pixels are decoded once
+		// the op is drawn
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(o.Data))
+		if err != nil || (format != "png" && format != "jpeg") {
+			return errors.New("invalid image")
+		}
+		if cfg.Width > MaxImageSize || cfg.Height > MaxImageSize {
+			return fmt.Errorf("image of %dx%d is too large", cfg.Width, cfg.Height)
+		}
+		if o.Scale <= 0 || o.Scale > MaxImageScale {
+			return fmt.Errorf("image scale %g out of range", o.Scale)
+		}
+		return inRange(o.X, o.Y)
+	case LayerOP:
+		if o.Name == "" || len(o.Name) > MaxLayerName || !utf8.ValidString(o.Name) {
+			return errors.New("invalid layer name")
+		}
+		if o.Blend > BlendAdd || o.At < 0 || o.At >= MaxLayers {
+			return errors.New("invalid layer")
+		}
+		return nil
+	case ViewOP:
+		if o.Width < 0 || o.Height < 0 || o.Width > MaxViewChunks ||
+			o.Height > MaxViewChunks || o.Width*o.Height > MaxViewChunks {
+			return fmt.Errorf("view of %dx%d chunks", o.Width, o.Height)
+		}
+		return inRange(float64(o.X)*ChunkSize, float64(o.Y)*ChunkSize)
+	case CursorOP:
+		return inRange(o.X, o.Y)
+	case KickOP:
+		return checkTarget(o.Target)
+	case BanOP:
+		return checkTarget(o.Target)
+	case EraseOP:
+		return checkTarget(o.Target)
+	case ClearRectOP:
+		if o.Width < 0 || o.Height < 0 || o.Width > MaxOpSize || o.Height > MaxOpSize {
+			return fmt.Errorf("clear of %dx%d", o.Width, o.Height)
+		}
+		return inRange(float64(o.X), float64(o.Y))
+	case UndoOP, RedoOP, ClearOP:
+		return nil
+	case InitOP, TileOP, ErrorOP, PresenceOP:
+		return errForbiddenOP
+	}
+	return errUnknownOP
+}
+
+func checkTarget(id string) error {
+	if id == "" || len(id) > MaxIDLen {
+		return errors.New("invalid target")
+	}
+	return nil
+}
+
+// checkFloats rejects NaN and Inf anywhere in v
+func checkFloats(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return errors.New("invalid number")
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := checkFloats(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := checkFloats(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+// replay renders a session recorded by the arty server with -record
+//
+//	replay -in data/rec/default.rec -at 5m -png out.png
+//	replay -in data/rec/default.rec -gif timelapse.gif -every 10s
+//	replay -in data/rec/default.rec -frames frames -every 1s
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+	"golang.org/x/image/draw"
+)
+
+func main() {
+	in := flag.String("in", "", "recording file")
+	at := flag.Duration("at", -1, "time since the start of the recording for -png, negative for the end")
+	pngOut := flag.String("png", "", "write the canvas at -at to this PNG file")
+	gifOut := flag.String("gif", "", "write a time-lapse to this GIF file")
+	framesOut := flag.String("frames", "", "write numbered PNG frames to this directory")
+	every := flag.Duration("every", time.Second, "recording time between frames")
+	delay := flag.Duration("delay", 100*time.Millisecond, "GIF frame delay")
+	scale := flag.Float64("scale", 1, "output scale")
+	fontDir := flag.String("fonts", "", "directory with extra TTF/OTF fonts, as given to the server")
+	x := flag.Int("x", 0, "left edge of the region to render")
+	y := flag.Int("y", 0, "top edge of the region to render")
+	width := flag.Int("width", 0, "region width, 0 for the drawn extent at the end of the recording")
+	height := flag.Int("height", 0, "region height, 0 for the drawn extent at the end of the recording")
+	maxSize := flag.Int("max", 4096, "largest output width and height, the drawn extent is scaled down to fit")
+	flag.Parse()
+
+	if *in == "" || (*pngOut == "" && *gifOut == "" && *framesOut == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *every <= 0 || *scale <= 0 || *maxSize <= 0 {
+		log.Fatal("-every, -scale and -max must be positive")
+	}
+	recs, err := readRecords(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(recs) == 0 {
+		log.Fatal("empty recording")
+	}
+	fonts, err := painter.NewFontCache()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *fontDir != "" {
+		if err := fonts.LoadDir(*fontDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	region := image.Rect(*x, *y, *x+*width, *y+*height)
+	if *width <= 0 || *height <= 0 {
+		p, err := replay(recs, -1, fonts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		region = p.Extent()
+		if fit := fitScale(region, *maxSize); fit < *scale {
+			log.Printf("scaling the extent %v by %g to fit in %d", region, fit, *maxSize)
+			*scale = fit
+		}
+	}
+	if fitScale(region, *maxSize) < *scale {
+		log.Fatalf("region %v at scale %g is larger than -max %d", region, *scale, *maxSize)
+	}
+
+	if *pngOut != "" {
+		p, err := replay(recs, *at, fonts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writePNG(*pngOut, p.ScaledRegion(region, *scale)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *gifOut == "" && *framesOut == "" {
+		return
+	}
+	if *framesOut != "" {
+		if err := os.MkdirAll(*framesOut, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+	anim := &gif.GIF{}
+	n := 0
+	err = frames(recs, *every, region, *scale, fonts, func(img *image.RGBA) error {
+		if *framesOut != "" {
+			name := filepath.Join(*framesOut, fmt.Sprintf("%06d.png", n))
+			if err := writePNG(name, img); err != nil {
+				return err
+			}
+		}
+		if *gifOut != "" {
+			anim.Image = append(anim.Image, paletted(img))
+			anim.Delay = append(anim.Delay, int(*delay/(10*time.Millisecond)))
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("rendered", n, "frames")
+	if *gifOut != "" {
+		if err := writeGIF(*gifOut, anim); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func readRecords(name string) ([]painter.Record, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := []painter.Record{}
+	rd := painter.NewRecordReader(f)
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, rec)
+	}
+}
+
+// replay draws the records up to at since the first one, or all of them if
+// at is negative
+func replay(recs []painter.Record, at time.Duration, fonts painter.FontCache) (*painter.BufPainter, error) {
+	p, err := painter.New()
+	if err != nil {
+		return nil, err
+	}
+	p.Fonts = fonts
+	start := recs[0].Time
+	for _, rec := range recs {
+		if at >= 0 && rec.Time.Sub(start) > at {
+			break
+		}
+		if err := p.HandleOP(rec.Message.Payload); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// frames replays recs calling fn with the canvas region at scale every step
+// of recording time, steps where nothing was drawn are skipped so idle time
+// doesn't produce duplicate frames
+func frames(recs []painter.Record, step time.Duration, region image.Rectangle, scale float64, fonts painter.FontCache, fn func(*image.RGBA) error) error {
+	p, err := painter.New()
+	if err != nil {
+		return err
+	}
+	p.Fonts = fonts
+	next := recs[0].Time.Add(step)
+	dirty := false
+	for _, rec := range recs {
+		if !rec.Time.Before(next) {
+			if dirty {
+				if err := fn(p.ScaledRegion(region, scale)); err != nil {
+					return err
+				}
+				dirty = false
+			}
+			// Jump over idle steps
+			for !rec.Time.Before(next) {
+				next = next.Add(step)
+			}
+		}
+		if err := p.HandleOP(rec.Message.Payload); err != nil {
+			return err
+		}
+		dirty = true
+	}
+	if dirty {
+		return fn(p.ScaledRegion(region, scale))
+	}
+	return nil
+}
+
+// fitScale returns the scale fitting r in a square of size
+func fitScale(r image.Rectangle, size int) float64 {
+	return math.Min(float64(size)/float64(r.Dx()), float64(size)/float64(r.Dy()))
+}
+
+// paletted flattens img on white at the origin, GIF has no partial
+// transparency
+func paletted(img *image.RGBA) *image.Paletted {
+	b := img.Bounds()
+	r := image.Rect(0, 0, b.Dx(), b.Dy())
+	flat := image.NewRGBA(r)
+	draw.Draw(flat, r, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, r, img, b.Min, draw.Over)
+
+	dst := image.NewPaletted(r, palette.Plan9)
+	draw.FloydSteinberg.Draw(dst, r, flat, image.Point{})
+	return dst
+}
+
+func writePNG(name string, img image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeGIF(name string, anim *gif.GIF) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(f, anim); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+// tokenCookie is the cookie HMACAuth reads a token from if the request has
+// no token parameter
+const tokenCookie = "arty_token"
+
+// anyRoom is the Room of a token valid in every room
+const anyRoom = "*"
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errNotAllowed   = errors.New("not allowed")
+)
+
+// Authenticator decides the role of a connection to a room from its upgrade
+// request, 0 or an error refuses it
+type Authenticator interface {
+	Authenticate(r *http.Request, room string) (uint8, error)
+}
+
+// OpenAuth grants its role to everyone
+type OpenAuth uint8
+
+func (a OpenAuth) Authenticate(r *http.Request, room string) (uint8, error) {
+	return uint8(a), nil
+}
+
+// Token grants Role in Room, or in every room if it is "*", until Expires
+type Token struct {
+	Room    string
+	Role    uint8
+	Expires time.Time
+}
+
+// HMACAuth grants the role of a token signed with Secret, taken from the
+// token query parameter or the arty_token cookie, requests without one get
+// the Default role
+type HMACAuth struct {
+	Secret  []byte
+	Default uint8
+}
+
+func (a HMACAuth) Authenticate(r *http.Request, room string) (uint8, error) {
+	s := r.URL.Query().Get("token")
+	if s == "" {
+		if c, err := r.Cookie(tokenCookie); err == nil {
+			s = c.Value
+		}
+	}
+	if s == "" {
+		return a.Default, nil
+	}
+	t, err := a.Verify(s)
+	if err != nil {
+		return 0, err
+	}
+	if t.Room != anyRoom && t.Room != room {
+		return 0, errors.New("token not valid for this room")
+	}
+	return t.Role, nil
+}
+
+// cookieAuth tells if a grants roles from the arty_token cookie, which the
+// browser sends whatever page opens the socket
+func cookieAuth(a Authenticator) bool {
+	switch a.(type) {
+	case HMACAuth, *HMACAuth:
+		return true
+	}
+	return false
+}
+
+// Sign returns t encoded and signed, room names have no separators so the
+// fields are joined as text
+func (a HMACAuth) Sign(t Token) string {
+	payload := fmt.Sprintf("%s|%d|%d", t.Room, t.Role, t.Expires.Unix())
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(payload)) + "." + enc.EncodeToString(a.mac(payload))
+}
+
+// Verify returns the token s was signed from, it fails if the signature
+// doesn't match or the token expired
+func (a HMACAuth) Verify(s string) (Token, error) {
+	enc := base64.RawURLEncoding
+	i := strings.IndexByte(s, '.')
+	if i == -1 {
+		return Token{}, errInvalidToken
+	}
+	payload, err := enc.DecodeString(s[:i])
+	if err != nil {
+		return Token{}, errInvalidToken
+	}
+	sig, err := enc.DecodeString(s[i+1:])
+	if err != nil || !hmac.Equal(sig, a.mac(string(payload))) {
+		return Token{}, errInvalidToken
+	}
+	f := strings.Split(string(payload), "|")
+	if len(f) != 3 {
+		return Token{}, errInvalidToken
+	}
+	role, err := strconv.ParseUint(f[1], 10, 8)
+	if err != nil {
+		return Token{}, errInvalidToken
+	}
+	exp, err := strconv.ParseInt(f[2], 10, 64)
+	if err != nil {
+		return Token{}, errInvalidToken
+	}
+	t := Token{Room: f[0], Role: uint8(role), Expires: time.Unix(exp, 0)}
+	if time.Now().After(t.Expires) {
+		return Token{}, errors.New("token expired")
+	}
+	return t, nil
+}
+
+func (a HMACAuth) mac(payload string) []byte {
+	h := hmac.New(sha256.New, a.Secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// LoadSecret reads the secret in name, a random one is written there if it
+// doesn't exist
+func LoadSecret(name string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(name)
+	if err == nil {
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, ioutil.WriteFile(name, secret, 0600)
+}
+
+// ParseRole returns the role named view, draw or admin, none is 0
+func ParseRole(s string) (uint8, error) {
+	switch s {
+	case "none":
+		return 0, nil
+	case "view":
+		return painter.RoleView, nil
+	case "draw":
+		return painter.RoleDraw, nil
+	case "admin":
+		return painter.RoleAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown role %q", s)
+}
+
+// requiredRole returns the role needed to send op, layer ops aren't undone
+// so deleting or hiding a layer takes an admin
+func requiredRole(op interface{}) uint8 {
+	switch o := op.(type) {
+	case painter.ViewOP, painter.CursorOP:
+		return painter.RoleView
+	case painter.ClearOP, painter.ClearRectOP, painter.KickOP,
+		painter.EraseOP, painter.BanOP:
+		return painter.RoleAdmin
+	case painter.LayerOP:
+		if o.Delete || o.Hidden || o.Opacity == 0 {
+			return painter.RoleAdmin
+		}
+	}
+	return painter.RoleDraw
+}
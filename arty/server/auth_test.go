@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+func TestRequiredRole(t *testing.T) {
+	layer := painter.LayerInfo{Name: "sketch", Opacity: 255}
+	tests := []struct {
+		op   interface{}
+		role uint8
+	}{
+		{painter.CursorOP{}, painter.RoleView},
+		{painter.ViewOP{}, painter.RoleView},
+		{painter.LineOP{}, painter.RoleDraw},
+		{painter.UndoOP{}, painter.RoleDraw},
+		{painter.LayerOP{LayerInfo: layer, At: 1}, painter.RoleDraw},
+		{painter.LayerOP{LayerInfo: painter.LayerInfo{Name: "sketch", Opacity: 100, Blend: painter.BlendAdd}}, painter.RoleDraw},
+		{painter.LayerOP{LayerInfo: layer, Delete: true}, painter.RoleAdmin},
+		{painter.LayerOP{LayerInfo: painter.LayerInfo{Name: "sketch", Opacity: 255, Hidden: true}}, painter.RoleAdmin},
+		{painter.LayerOP{LayerInfo: painter.LayerInfo{Name: "sketch"}}, painter.RoleAdmin},
+		{painter.ClearOP{}, painter.RoleAdmin},
+		{painter.ClearRectOP{}, painter.RoleAdmin},
+		{painter.KickOP{}, painter.RoleAdmin},
+		{painter.EraseOP{}, painter.RoleAdmin},
+		{painter.BanOP{}, painter.RoleAdmin},
+	}
+	for _, tt := range tests {
+		if got := requiredRole(tt.op); got != tt.role {
+			t.Errorf("%#v: role %d, want %d", tt.op, got, tt.role)
+		}
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	auth := HMACAuth{Secret: []byte("secret"), Default: painter.RoleDraw}
+	_, srv := testServer(t, Config{Auth: auth})
+	token := func(room string, role uint8) string {
+		return auth.Sign(Token{Room: room, Role: role, Expires: time.Now().Add(time.Hour)})
+	}
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"garbage", http.StatusUnauthorized},
+		{token("default", painter.RoleAdmin), http.StatusUnauthorized},
+		{token(anyRoom, painter.RoleDraw), http.StatusForbidden},
+		{token(anyRoom, painter.RoleAdmin), http.StatusOK},
+	}
+	for _, path := range []string{"/rooms", "/debug/vars"} {
+		for _, tt := range tests {
+			res, err := http.Get(srv.URL + path + "?token=" + url.QueryEscape(tt.token))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.status {
+				t.Errorf("%s token %q: status %d, want %d", path, tt.token, res.StatusCode, tt.status)
+			}
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	auth := HMACAuth{Secret: []byte("secret"), Default: painter.RoleDraw}
+	tests := []struct {
+		cfg    Config
+		origin string
+		ok     bool
+	}{
+		{Config{Auth: OpenAuth(painter.RoleDraw)}, "http://evil.test", true},
+		{Config{Auth: auth}, "", true},
+		{Config{Auth: auth}, "http://arty.test", true},
+		{Config{Auth: auth}, "http://ARTY.test", true},
+		{Config{Auth: auth}, "http://evil.test", false},
+		{Config{Auth: auth}, "http://arty.test.evil.test", false},
+		{Config{Auth: auth, Origins: []string{"http://evil.test"}}, "http://evil.test", true},
+		{Config{Auth: auth, Origins: []string{"http://evil.test"}}, "http://arty.test", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://arty.test/room/x", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := tt.cfg.checkOrigin(r); got != tt.ok {
+			t.Errorf("%T origins %v, origin %q: %v, want %v", tt.cfg.Auth, tt.cfg.Origins, tt.origin, got, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"image"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+const (
+	// outQueueSize is the number of messages a client may have pending,
+	// enough for the tiles of the largest view
+	outQueueSize = painter.MaxViewChunks * painter.MaxLayers
+	writeTimeout = 10 * time.Second
+)
+
+var errClientClosed = errors.New("client closed")
+
+var (
+	metrics      = expvar.NewMap("arty")
+	queueDepth   = new(expvar.Int)
+	sentMessages = new(expvar.Int)
+	dropped      = new(expvar.Int)
+	evictions    = new(expvar.Int)
+	rejected     = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("queue_depth", queueDepth)
+	metrics.Set("sent", sentMessages)
+	metrics.Set("dropped", dropped)
+	metrics.Set("evicted", evictions)
+	metrics.Set("rejected", rejected)
+}
+
+// Cli is a connected client, messages are queued and written by its own
+// goroutine so a slow socket never blocks the room, a client that lets its
+// queue fill up is disconnected
+type Cli struct {
+	id        string
+	conn      *websocket.Conn
+	codec     painter.Codec
+	pingEvery time.Duration
+
+	// view is the range of chunks the client sees, guarded by its room
+	view image.Rectangle
+	// presence is its name, color and cursor
+	presence presence
+	// role in the room, see painter.RoleView
+	role uint8
+	// addr is the remote host, bans are by address
+	addr string
+
+	out  chan []byte
+	done chan struct{}
+	// mu orders send and close so nothing is queued after close, closed
+	// is guarded by it
+	mu     sync.Mutex
+	closed bool
+}
+
+// newCli starts the client writer, a ping is sent every pingEvery and the
+// connection is considered dead if nothing, pongs included, is read for
+// twice that
+func newCli(conn *websocket.Conn, codec painter.Codec, pingEvery time.Duration) *Cli {
+	c := &Cli{
+		id:        newID(),
+		conn:      conn,
+		codec:     codec,
+		pingEvery: pingEvery,
+		out:       make(chan []byte, outQueueSize),
+		done:      make(chan struct{}),
+	}
+	conn.SetReadDeadline(c.readDeadline())
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(c.readDeadline())
+	})
+	go c.writeLoop()
+	return c
+}
+
+func (c *Cli) readDeadline() time.Time {
+	return time.Now().Add(2 * c.pingEvery)
+}
+
+// read returns the next data message, extending the read deadline
+func (c *Cli) read() (int, []byte, error) {
+	mt, msg, err := c.conn.ReadMessage()
+	if err != nil {
+		return mt, msg, err
+	}
+	return mt, msg, c.conn.SetReadDeadline(c.readDeadline())
+}
+
+func (c *Cli) writeLoop() {
+	mt := websocket.TextMessage
+	if c.codec == painter.CodecBinary {
+		mt = websocket.BinaryMessage
+	}
+	ping := time.NewTicker(c.pingEvery)
+	defer ping.Stop()
+	defer c.drain()
+	for {
+		select {
+		case <-ping.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			if err != nil {
+				if err != websocket.ErrCloseSent {
+					log.Println("ping error", c.id, err)
+				}
+				c.close()
+				return
+			}
+		case msg := <-c.out:
+			queueDepth.Add(-1)
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteMessage(mt, msg); err != nil {
+				log.Println("write error", c.id, err)
+				c.close()
+				return
+			}
+			sentMessages.Add(1)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// drain closes the client and drops whatever is left in its queue, it is
+// the only place queued messages are dropped
+func (c *Cli) drain() {
+	c.close()
+	for {
+		select {
+		case <-c.out:
+			queueDepth.Add(-1)
+			dropped.Add(1)
+		default:
+			return
+		}
+	}
+}
+
+// send queues msg, it never blocks
+func (c *Cli) send(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClientClosed
+	}
+	select {
+	case c.out <- msg:
+		queueDepth.Add(1)
+		return nil
+	default:
+		dropped.Add(1)
+		evictions.Add(1)
+		log.Println("evicting slow client", c.id)
+		c.closeLocked()
+		return errClientClosed
+	}
+}
+
+// sees reports whether the client view covers any of r, everything is
+// seen everywhere
+func (c *Cli) sees(r image.Rectangle) bool {
+	return r == everywhere || r.Overlaps(painter.ChunkRect(c.view))
+}
+
+func (c *Cli) sendMessage(m painter.Message) error {
+	buf, err := c.codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.send(buf)
+}
+
+// reject tells the client the message with ref was refused
+func (c *Cli) reject(ref uint32, err error) {
+	rejected.Add(1)
+	c.sendMessage(painter.Message{
+		Ref:     ref,
+		Payload: painter.ErrorOP{Reason: err.Error()},
+	})
+}
+
+// shutdown sends a close frame with code and reason before closing
+func (c *Cli) shutdown(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeTimeout))
+	if err != nil && err != websocket.ErrCloseSent {
+		log.Println("close frame error", c.id, err)
+	}
+	c.close()
+}
+
+// close stops the writer and closes the connection, which makes the read
+// loop return
+func (c *Cli) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+}
+
+func (c *Cli) closeLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.done)
+	c.conn.Close()
+}
+
+// newID returns a random client id used as op author
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
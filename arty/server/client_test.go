@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+// testConn returns the server side of a websocket connection
+func testConn(t *testing.T) *websocket.Conn {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return <-conns
+}
+
+func TestCliWriteErrorDrains(t *testing.T) {
+	conn := testConn(t)
+	depth, drops := queueDepth.Value(), dropped.Value()
+	// Writes fail from the first one
+	conn.UnderlyingConn().Close()
+	c := newCli(conn, painter.CodecJSON, time.Hour)
+	queued := int64(0)
+	for i := 0; i < 10; i++ {
+		if c.send([]byte("{}")) == nil {
+			queued++
+		}
+	}
+	<-c.done
+	if err := c.send([]byte("{}")); err != errClientClosed {
+		t.Fatal("send after close:", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for queueDepth.Value() != depth && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if d := queueDepth.Value(); d != depth {
+		t.Fatalf("queue depth %d after close, want %d", d, depth)
+	}
+	// The one that failed to write was taken from the queue
+	if d := dropped.Value() - drops; d != queued-1 {
+		t.Fatalf("%d dropped of %d queued", d, queued)
+	}
+}
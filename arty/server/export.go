@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+const (
+	// maxExportSize bounds the width and height of a rendered image
+	maxExportSize = 4096
+	// maxExportScale is the largest zoom of /canvas
+	maxExportScale = 8
+	// defaultThumbSize and maxThumbSize are the edge of the square a
+	// thumbnail fits in
+	defaultThumbSize = 256
+	maxThumbSize     = 1024
+)
+
+// serveCanvas renders a room as PNG, the drawn area or the one given by the
+// x, y, w and h parameters, scaled by the scale parameter, without it areas
+// larger than maxExportSize are scaled down to fit
+func (s *CanvasServer) serveCanvas(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	fit := q.Get("scale") == ""
+	scale, err := floatParam(q, "scale", 1)
+	if err != nil || scale <= 0 || scale > maxExportScale {
+		http.Error(w, "invalid scale", http.StatusBadRequest)
+		return
+	}
+	region, err := regionParam(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.servePNG(w, r, "/canvas/", func(extent image.Rectangle) (image.Rectangle, float64) {
+		rect := extent
+		if !region.Empty() {
+			rect = region
+		}
+		if fit {
+			return rect, math.Min(scale, fitScale(rect, maxExportSize))
+		}
+		return rect, scale
+	})
+}
+
+// serveThumb renders the drawn area of a room as PNG fitted in a square of
+// the size parameter, small canvases aren't enlarged
+func (s *CanvasServer) serveThumb(w http.ResponseWriter, r *http.Request) {
+	size, err := floatParam(r.URL.Query(), "size", defaultThumbSize)
+	if err != nil || size < 1 || size > maxThumbSize {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+	s.servePNG(w, r, "/thumb/", func(extent image.Rectangle) (image.Rectangle, float64) {
+		return extent, math.Min(fitScale(extent, size), 1)
+	})
+}
+
+// servePNG writes the area of the room named in the path after prefix as
+// PNG, area picks it from the drawn extent, the ETag changes with the room
+// seq so HEAD and If-None-Match don't need to render anything, only rooms
+// in memory or stored are served
+func (s *CanvasServer) servePNG(w http.ResponseWriter, r *http.Request, prefix string, area func(extent image.Rectangle) (image.Rectangle, float64)) {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if !strings.HasSuffix(name, ".png") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, ".png")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, _, ok := s.authorize(w, r, name); !ok {
+		return
+	}
+	room, err := s.acquire(name, false)
+	if err == errNoRoom {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer s.release(room)
+
+	room.mu.Lock()
+	if room.closed {
+		room.mu.Unlock()
+		http.Error(w, errRoomClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, room.epoch, room.seq)
+	extent := room.painter.Extent()
+	if extent.Empty() {
+		// A blank canvas is a transparent pixel
+		extent = image.Rect(0, 0, 1, 1)
+	}
+	rect, scale := area(extent)
+	if float64(rect.Dx())*scale > maxExportSize || float64(rect.Dy())*scale > maxExportSize {
+		room.mu.Unlock()
+		http.Error(w, "image too large", http.StatusBadRequest)
+		return
+	}
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Content-Type", "image/png")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		room.mu.Unlock()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		room.mu.Unlock()
+		return
+	}
+	img := room.painter.ScaledRegion(rect, scale)
+	room.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		log.Println("png encode error", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// etagMatch reports whether the If-None-Match header lists etag
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// fitScale returns the scale fitting r in a square of size
+func fitScale(r image.Rectangle, size float64) float64 {
+	return math.Min(size/float64(r.Dx()), size/float64(r.Dy()))
+}
+
+func floatParam(q url.Values, key string, def float64) (float64, error) {
+	v := q.Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// regionParam returns the canvas area given by x, y, w and h, or an empty
+// one if there's no w and h
+func regionParam(q url.Values) (image.Rectangle, error) {
+	if q.Get("w") == "" && q.Get("h") == "" {
+		return image.Rectangle{}, nil
+	}
+	v := [4]int{}
+	for i, key := range []string{"x", "y", "w", "h"} {
+		if q.Get(key) == "" && i < 2 {
+			continue
+		}
+		n, err := strconv.Atoi(q.Get(key))
+		if err != nil || n < -painter.MaxCoord || n > 2*painter.MaxCoord {
+			return image.Rectangle{}, fmt.Errorf("invalid %s", key)
+		}
+		v[i] = n
+	}
+	if v[2] <= 0 || v[3] <= 0 {
+		return image.Rectangle{}, errors.New("invalid region size")
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+func TestExportExistingRooms(t *testing.T) {
+	dir := testStore(t)
+	rec := testStore(t)
+	_, srv := testServer(t, Config{DataDir: dir, RecordDir: rec})
+
+	for _, path := range []string{"/canvas/nope.png", "/thumb/nope.png"} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, err := http.NewRequest(method, srv.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusNotFound {
+				t.Errorf("%s %s: status %d, want 404", method, path, res.StatusCode)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nope")); !os.IsNotExist(err) {
+		t.Error("export created a room store:", err)
+	}
+	if _, err := os.Stat(filepath.Join(rec, "nope.rec")); !os.IsNotExist(err) {
+		t.Error("export created a recording:", err)
+	}
+
+	c := dial(t, srv, "/room/here")
+	for _, path := range []string{"/canvas/here.png", "/thumb/here.png"} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", path, res.StatusCode)
+		}
+	}
+	c.Close()
+}
+
+func TestExportStoredRoom(t *testing.T) {
+	dir := testStore(t)
+	s, srv := testServer(t, Config{DataDir: dir})
+	dial(t, srv, "/room/stored").Close()
+	s.Close()
+
+	// A new server has the room on disk only
+	_, srv = testServer(t, Config{DataDir: dir})
+	res, err := http.Get(srv.URL + "/canvas/stored.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want 200", res.StatusCode)
+	}
+}
+
+func TestExportFit(t *testing.T) {
+	_, srv := testServer(t, Config{})
+	c := dial(t, srv, "/room/fit")
+	for i, x := range []float64{0, 5000} {
+		m := painter.Message{Ref: uint32(i + 1), Payload: painter.RectOP{
+			Color: color.RGBA{255, 0, 0, 255}, Fill: true, X1: x, Y1: 0, X2: x + 100, Y2: 100,
+		}}
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := waitRef(t, c, m.Ref).Payload.(painter.ErrorOP); ok {
+			t.Fatal("rect rejected:", e)
+		}
+	}
+
+	res, err := http.Get(srv.URL + "/canvas/fit.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", res.StatusCode)
+	}
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != maxExportSize || b.Dy() > maxExportSize {
+		t.Errorf("image size %v, want %d wide", b.Size(), maxExportSize)
+	}
+
+	res, err = http.Get(srv.URL + "/canvas/fit.png?scale=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("scale=1: status %d, want 400", res.StatusCode)
+	}
+}
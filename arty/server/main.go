@@ -1,114 +1,120 @@
 package main
 
 import (
-	"image/color"
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/stdiopt/gowasm-experiments/arty/painter"
-
-	"github.com/gorilla/websocket"
 )
 
 func main() {
-	addr := ":4444"
-	log.Println("Listening at ", addr)
-	server, err := NewCanvasServer(1920, 1080)
-	if err != nil {
-		log.Fatal("error starting canvas server", err)
-	}
-	http.ListenAndServe(addr, server)
-}
+	addr := flag.String("addr", ":4444", "listen address")
+	cfg := Config{}
+	flag.StringVar(&cfg.DataDir, "data", "data", "canvas storage directory, empty to disable")
+	flag.DurationVar(&cfg.SnapshotEvery, "snapshot", time.Minute, "canvas snapshot interval")
+	flag.StringVar(&cfg.RecordDir, "record", "", "session recording directory, empty to disable")
+	flag.DurationVar(&cfg.IdleTimeout, "idle", 10*time.Minute, "free rooms without clients after")
+	flag.DurationVar(&cfg.PingEvery, "ping", 30*time.Second, "keepalive ping interval")
+	flag.Float64Var(&cfg.OPRate, "oprate", 100, "ops per second allowed per connection")
+	flag.IntVar(&cfg.OPBurst, "opburst", 200, "ops a connection may send in a burst")
+	fontDir := flag.String("fonts", "", "directory with extra TTF/OTF fonts")
+	secret := flag.String("secret", "", "HMAC secret file for tokens, created if missing, empty to let everyone in")
+	defaultRole := flag.String("role", "draw", "role without a token: none, view, draw or admin")
+	origins := flag.String("origins", "", "comma separated origins allowed to connect, empty for any or the same origin with -secret")
+	mint := flag.String("mint", "", "print a token for room:role, room * is any room, and exit")
+	mintTTL := flag.Duration("mint-ttl", 30*24*time.Hour, "validity of a minted token")
+	audit := flag.String("audit", "audit.log", "admin actions log file, empty to disable")
+	flag.Parse()
 
-type CanvasServer struct {
-	painter *painter.BufPainter
-	clients sync.Map
-}
-
-func NewCanvasServer(w, h int) (*CanvasServer, error) {
-	p, err := painter.New()
+	role, err := ParseRole(*defaultRole)
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
 	}
-	p.Init(painter.InitOP{Width: w, Height: h})
-
-	p.HandleOP(painter.TextOP{
-		Color: color.RGBA{R: 0, G: 0, B: 0, A: 255},
-		X:     10.0,
-		Y:     10.0,
-		Text:  "Hello world",
-	})
-	return &CanvasServer{p, sync.Map{}}, nil
-}
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-func (s *CanvasServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println("Receiving connection from:", r.RemoteAddr)
-	c, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("upgrade err", err)
-		return
+	cfg.Auth = OpenAuth(role)
+	if *secret != "" {
+		key, err := LoadSecret(*secret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Auth = HMACAuth{Secret: key, Default: role}
 	}
-
-	c.WriteJSON(painter.Message{painter.InitOP{
-		Width:  s.painter.Width(),
-		Height: s.painter.Height(),
-		Data:   s.painter.ImageData(),
-	}})
-	if err != nil {
-		log.Println("sending msg error")
+	if *mint != "" {
+		auth, ok := cfg.Auth.(HMACAuth)
+		if !ok {
+			log.Fatal("-mint needs -secret")
+		}
+		i := strings.LastIndexByte(*mint, ':')
+		if i == -1 {
+			log.Fatal("-mint wants room:role")
+		}
+		role, err := ParseRole((*mint)[i+1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(auth.Sign(Token{
+			Room:    (*mint)[:i],
+			Role:    role,
+			Expires: time.Now().Add(*mintTTL),
+		}))
 		return
 	}
-
-	ncli := &Cli{conn: c}
-	s.clients.Store(ncli, true)
-	defer func() {
-		c.Close()
-		s.clients.Delete(ncli)
-	}()
-	for {
-		mt, message, err := c.ReadMessage()
+	if *origins != "" {
+		cfg.Origins = strings.Split(*origins, ",")
+	}
+	if *audit != "" {
+		f, err := os.OpenFile(*audit, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 		if err != nil {
-			log.Println("Bye bye", r.RemoteAddr)
-			return
-		}
-		if mt != websocket.TextMessage {
-			continue
+			log.Fatal(err)
 		}
-		// draw in server
-		err = s.painter.HandleRaw(message)
+		defer f.Close()
+		cfg.Audit = f
+	}
+
+	if *fontDir != "" {
+		fonts, err := painter.NewFontCache()
 		if err != nil {
-			log.Println("what?", err)
+			log.Fatal(err)
 		}
+		if err := fonts.LoadDir(*fontDir); err != nil {
+			log.Fatal(err)
+		}
+		cfg.Fonts = fonts
+	}
 
-		// Broadcast to other clients
-		s.clients.Range(func(key, value interface{}) bool {
-			cl := key.(*Cli)
-			if cl == ncli {
-				return true
-			}
-			err := cl.send(mt, message)
-			if err != nil {
-				log.Println("Erro: sending to cli", err)
-			}
-			return true
-		})
+	server := NewCanvasServer(cfg)
+	httpServer := &http.Server{Addr: *addr, Handler: server}
 
-	}
-}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
 
-// Cli concurrent safe client
-type Cli struct {
-	sync.Mutex
-	conn *websocket.Conn
-}
+		// Stop listening first, websockets are hijacked so Shutdown
+		// doesn't wait for them, the canvas server closes those
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Println("error shutting down http server", err)
+		}
+		if err := server.Close(); err != nil {
+			log.Println("error closing canvas server", err)
+		}
+	}()
 
-func (c *Cli) send(mt int, msg []byte) error {
-	c.Lock()
-	defer c.Unlock()
-	return c.conn.WriteMessage(mt, msg)
+	log.Println("Listening at ", *addr)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-closed
 }
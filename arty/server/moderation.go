@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+// bansFile lists the banned addresses of each room in the data directory
+const bansFile = "bans.json"
+
+var errNoSuchUser = errors.New("no such user")
+
+// AuditEntry is a line of the audit log, an admin op sent to a room and its
+// Error if it failed
+type AuditEntry struct {
+	Time    time.Time
+	Room    string
+	Admin   string
+	Name    string
+	Addr    string
+	OP      string
+	Payload interface{}
+	Error   string `json:",omitempty"`
+}
+
+// auditLog writes AuditEntry JSON lines
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	if w == nil {
+		return nil
+	}
+	return &auditLog{enc: json.NewEncoder(w)}
+}
+
+// write logs the op sent by cl to room, a nil log writes nothing
+func (a *auditLog) write(room string, cl *Cli, op interface{}, err error) {
+	if a == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:    time.Now(),
+		Room:    room,
+		Admin:   cl.id,
+		Name:    cl.presence.name,
+		Addr:    cl.addr,
+		OP:      reflect.TypeOf(op).Name(),
+		Payload: op,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(e); err != nil {
+		log.Println("audit log error", err)
+	}
+}
+
+// erase removes the ops of a user since a time and sends the redrawn area
+// as tiles, like undo
+func (r *Room) erase(from *Cli, op painter.EraseOP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errRoomClosed
+	}
+	log.Println("room", r.name, "erased", op.Target, "by", from.id)
+	r.rebuilt = image.Rectangle{}
+	if !r.painter.EraseAuthor(op.Target, time.Unix(op.Since, 0)) {
+		return errors.New("nothing to erase")
+	}
+	return r.sendRebuilt()
+}
+
+// addrOf returns the address of the client with id
+func (r *Room) addrOf(id string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for cl := range r.clients {
+		if cl.id == id {
+			return cl.addr, true
+		}
+	}
+	return "", false
+}
+
+// kickAddr disconnects every client from addr
+func (r *Room) kickAddr(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for cl := range r.clients {
+		if cl.addr == addr {
+			cl.shutdown(websocket.ClosePolicyViolation, "banned")
+		}
+	}
+}
+
+// ban refuses the address of the user with id in room from now on and
+// disconnects the clients using it, a room admin has no say in other rooms
+func (s *CanvasServer) ban(room *roomRef, from *Cli, id string) error {
+	addr, ok := room.addrOf(id)
+	if !ok {
+		return errNoSuchUser
+	}
+	if addr == from.addr {
+		return errors.New("can't ban your own address")
+	}
+	s.mu.Lock()
+	if s.bans[room.name] == nil {
+		s.bans[room.name] = map[string]bool{}
+	}
+	s.bans[room.name][addr] = true
+	err := s.saveBans()
+	s.mu.Unlock()
+
+	log.Println("room", room.name, "banned", addr, "by", from.id)
+	room.kickAddr(addr)
+	return err
+}
+
+func (s *CanvasServer) banned(room, addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bans[room][addr]
+}
+
+// loadBans reads the banned addresses from the data directory if any
+func (s *CanvasServer) loadBans() error {
+	if s.cfg.DataDir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.cfg.DataDir, bansFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rooms := map[string][]string{}
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return err
+	}
+	for room, addrs := range rooms {
+		s.bans[room] = map[string]bool{}
+		for _, a := range addrs {
+			s.bans[room][a] = true
+		}
+	}
+	return nil
+}
+
+// saveBans writes the banned addresses to the data directory, s.mu must be
+// held
+func (s *CanvasServer) saveBans() error {
+	if s.cfg.DataDir == "" {
+		return nil
+	}
+	rooms := map[string][]string{}
+	for room, bans := range s.bans {
+		addrs := []string{}
+		for a := range bans {
+			addrs = append(addrs, a)
+		}
+		sort.Strings(addrs)
+		rooms[room] = addrs
+	}
+	if err := os.MkdirAll(s.cfg.DataDir, 0755); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(s.cfg.DataDir, bansFile), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(rooms)
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"hash/fnv"
+	"image/color"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+// cursorEvery is the shortest interval between the cursor broadcasts of a
+// client, moves in between only send the last position
+const cursorEvery = 50 * time.Millisecond
+
+// maxNameLen is the number of runes of a display name
+const maxNameLen = 32
+
+// palette are the colors given to users, picked by their id
+var palette = []color.RGBA{
+	{0xe6, 0x19, 0x4b, 0xff},
+	{0x3c, 0xb4, 0x4b, 0xff},
+	{0x43, 0x63, 0xd8, 0xff},
+	{0xf5, 0x82, 0x31, 0xff},
+	{0x91, 0x1e, 0xb4, 0xff},
+	{0x42, 0xd4, 0xf4, 0xff},
+	{0xf0, 0x32, 0xe6, 0xff},
+	{0x9a, 0x63, 0x24, 0xff},
+	{0x46, 0x99, 0x90, 0xff},
+	{0x80, 0x00, 0x00, 0xff},
+	{0x00, 0x00, 0x75, 0xff},
+	{0x80, 0x80, 0x00, 0xff},
+}
+
+// presence is what the other clients know about a client
+type presence struct {
+	name  string
+	color color.RGBA
+
+	// cursor is the last position sent by the client, cursorSent when it
+	// was last broadcast and cursorTimer the pending broadcast, all guarded
+	// by the room
+	cursor      *painter.CursorOP
+	cursorSent  time.Time
+	cursorTimer *time.Timer
+}
+
+// newPresence returns the presence of the client with id, name is the one
+// the client asked for, a guest name is used if it isn't valid
+func newPresence(id, name string) presence {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return presence{
+		name:  displayName(name, id),
+		color: palette[h.Sum32()%uint32(len(palette))],
+	}
+}
+
+// displayName returns name trimmed if it is printable and not too long,
+// otherwise a guest name from id
+func displayName(name, id string) string {
+	name = strings.TrimSpace(name)
+	valid := name != "" && utf8.ValidString(name) && utf8.RuneCountInString(name) <= maxNameLen
+	for _, r := range name {
+		valid = valid && unicode.IsPrint(r)
+	}
+	if !valid {
+		return "guest " + id[:4]
+	}
+	return name
+}
+
+// presenceOP returns the presence of cl as sent to the other clients
+func presenceOP(cl *Cli) painter.PresenceOP {
+	return painter.PresenceOP{
+		Author: cl.id,
+		Name:   cl.presence.name,
+		Color:  cl.presence.color,
+	}
+}
+
+// announce sends the users already in the room to cl, with their last
+// cursor, and cl to them, the lock must be held
+func (r *Room) announce(cl *Cli) error {
+	self := presenceOP(cl)
+	self.Self = true
+	self.Role = cl.role
+	if err := cl.sendMessage(painter.Message{Payload: self}); err != nil {
+		return err
+	}
+	for other := range r.clients {
+		if err := cl.sendMessage(painter.Message{Payload: presenceOP(other)}); err != nil {
+			return err
+		}
+		if c := other.presence.cursor; c != nil {
+			if err := cl.sendMessage(painter.Message{Payload: *c}); err != nil {
+				return err
+			}
+		}
+	}
+	r.broadcast(cl, painter.Message{Payload: presenceOP(cl)}, everywhere)
+	return nil
+}
+
+// depart tells the room cl left, the lock must be held
+func (r *Room) depart(cl *Cli) {
+	if t := cl.presence.cursorTimer; t != nil {
+		t.Stop()
+		cl.presence.cursorTimer = nil
+	}
+	left := presenceOP(cl)
+	left.Left = true
+	r.broadcast(cl, painter.Message{Payload: left}, everywhere)
+}
+
+// cursor relays the cursor of cl to the other clients, at most once every
+// cursorEvery, a move within that is sent when the interval ends
+func (r *Room) cursor(cl *Cli, op painter.CursorOP) error {
+	if err := painter.Validate(op); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errRoomClosed
+	}
+	p := &cl.presence
+	p.cursor = &op
+	if p.cursorTimer != nil {
+		// Already scheduled, it will send this position
+		return nil
+	}
+	wait := cursorEvery - time.Since(p.cursorSent)
+	if wait <= 0 {
+		r.sendCursor(cl)
+		return nil
+	}
+	p.cursorTimer = time.AfterFunc(wait, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		p.cursorTimer = nil
+		if r.clients[cl] {
+			r.sendCursor(cl)
+		}
+	})
+	return nil
+}
+
+// sendCursor broadcasts the last cursor of cl, the lock must be held
+func (r *Room) sendCursor(cl *Cli) {
+	p := &cl.presence
+	p.cursorSent = time.Now()
+	r.broadcast(cl, painter.Message{Payload: *p.cursor}, everywhere)
+}
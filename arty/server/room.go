@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+var errRoomClosed = errors.New("room closed")
+
+// everywhere is the area of ops that change the whole canvas, i.e. layer
+// changes, every client gets them
+var everywhere = image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32)
+
+// Room is a named canvas shared by its clients
+type Room struct {
+	name string
+
+	// mu guards everything below
+	mu      sync.Mutex
+	painter *painter.BufPainter
+	store   *Store
+	// recording is optional, see Record
+	recording io.WriteCloser
+	recorder  *painter.Recorder
+	// area redrawn by undo/redo while applying an op
+	rebuilt image.Rectangle
+	// area drawn by the op being applied
+	drawn image.Rectangle
+	// seq of the last accepted op, it goes on from the stored one so the
+	// store can tell what its snapshot covers, epoch tells apart the loads
+	// of rooms without a store
+	seq     uint64
+	epoch   int64
+	clients map[*Cli]bool
+	closed  bool
+}
+
+// NewRoom creates a room canvas, if store is not nil the canvas is restored
+// from it and every applied operation is persisted, fonts replaces the
+// embedded font cache if not nil
+func NewRoom(name string, store *Store, fonts painter.FontCache) (*Room, error) {
+	p, err := painter.New()
+	if err != nil {
+		return nil, err
+	}
+	if fonts != nil {
+		p.Fonts = fonts
+	}
+	p.EnableHistory()
+	loaded := false
+	if store != nil {
+		loaded, err = store.Load(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !loaded {
+		p.Init(painter.InitOP{})
+
+		p.HandleOP(painter.TextOP{
+			Color: color.RGBA{R: 0, G: 0, B: 0, A: 255},
+			X:     10.0,
+			Y:     10.0,
+			Text:  "Hello world",
+		})
+	}
+	r := &Room{
+		name:    name,
+		painter: p,
+		store:   store,
+		epoch:   time.Now().UnixNano(),
+		clients: map[*Cli]bool{},
+	}
+	if store != nil {
+		r.seq = store.Seq()
+	}
+	p.OnRebuild = func(rect image.Rectangle) {
+		r.rebuilt = r.rebuilt.Union(rect)
+	}
+	p.OnDraw = func(rect image.Rectangle) {
+		r.drawn = rect
+	}
+	return r, nil
+}
+
+// join sends the canvas layers to cl and adds it to the room, both under
+// the lock so no op is missed in between, the client gets the tiles of the
+// chunks it sees once it sends its view, users are told about each other
+func (r *Room) join(cl *Cli) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errRoomClosed
+	}
+	err := cl.sendMessage(painter.Message{
+		Seq:     r.seq,
+		Payload: painter.InitOP{Layers: r.painter.Layers()},
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.announce(cl); err != nil {
+		return err
+	}
+	r.clients[cl] = true
+	return nil
+}
+
+func (r *Room) leave(cl *Cli) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.clients[cl] {
+		return
+	}
+	delete(r.clients, cl)
+	r.depart(cl)
+}
+
+// view subscribes cl to the chunks of v and sends it the tiles of the
+// chunks it didn't see before, all with the current seq
+func (r *Room) view(cl *Cli, v painter.ViewOP) error {
+	if err := painter.Validate(v); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errRoomClosed
+	}
+	cr := image.Rect(v.X, v.Y, v.X+v.Width, v.Y+v.Height)
+	tiles, err := r.painter.ChunkTiles(cr)
+	if err != nil {
+		return err
+	}
+	seen := painter.ChunkRect(cl.view)
+	cl.view = cr
+	for _, t := range tiles {
+		if image.Pt(t.X, t.Y).In(seen) {
+			continue
+		}
+		if err := cl.sendMessage(painter.Message{Seq: r.seq, Payload: t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply draws m in the room canvas, stamps it with the next seq, persists
+// it and sends it to every client, the sender gets it with its Ref so it can
+// reconcile
+func (r *Room) apply(from *Cli, m painter.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errRoomClosed
+	}
+	err := painter.Validate(m.Payload)
+	if err != nil {
+		return err
+	}
+	r.rebuilt, r.drawn = image.Rectangle{}, image.Rectangle{}
+	if err := r.painter.HandleOP(m.Payload); err != nil {
+		return err
+	}
+	switch m.Payload.(type) {
+	case painter.UndoOP, painter.RedoOP:
+		return r.sendRebuilt()
+	}
+	if !r.rebuilt.Empty() {
+		// A text edit replaced an earlier op
+		return r.sendRebuilt()
+	}
+	r.seq++
+	m.Seq = r.seq
+	if err := from.sendMessage(m); err != nil && err != errClientClosed {
+		log.Println("Erro: sending to cli", err)
+	}
+	m.Ref = 0
+	switch m.Payload.(type) {
+	case painter.LayerOP:
+		r.broadcast(from, m, everywhere)
+	case painter.FloodFillOP:
+		// Clients only have the chunks they see so they can't tell where
+		// a fill stops, everyone gets the result instead
+		if err := r.sendTiles(r.drawn, m.Seq); err != nil {
+			return err
+		}
+	default:
+		r.broadcast(from, m, r.drawn)
+	}
+	return r.persist(m)
+}
+
+// clear blanks every layer of the canvas, clients get an InitOP as if they
+// just joined and history starts over
+func (r *Room) clear(from *Cli) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errRoomClosed
+	}
+	log.Println("room", r.name, "cleared by", from.id)
+	op := painter.InitOP{Layers: r.painter.Layers()}
+	r.painter.Init(op)
+	r.seq++
+	m := painter.Message{Seq: r.seq, Payload: op}
+	r.broadcast(nil, m, everywhere)
+	return r.persist(m)
+}
+
+// kick disconnects the client with id, its connection closes and it leaves
+// the room as usual
+func (r *Room) kick(from *Cli, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for cl := range r.clients {
+		if cl.id == id {
+			log.Println("room", r.name, "kicked", id, "by", from.id)
+			cl.shutdown(websocket.ClosePolicyViolation, "kicked")
+			return nil
+		}
+	}
+	return errNoSuchUser
+}
+
+// sendRebuilt sends the area redrawn by undo, redo or a text edit as tiles
+// to every client, clients keep no history so they can't replay it
+// themselves
+func (r *Room) sendRebuilt() error {
+	if r.rebuilt.Empty() {
+		return nil
+	}
+	tiles, err := r.painter.TilesIn(r.rebuilt)
+	if err != nil {
+		return err
+	}
+	for _, t := range tiles {
+		r.seq++
+		tm := painter.Message{Seq: r.seq, Payload: t}
+		r.broadcast(nil, tm, tileRect(t))
+		if err := r.persist(tm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendTiles sends the tiles of area with seq to every client that sees
+// them, they are not persisted
+func (r *Room) sendTiles(area image.Rectangle, seq uint64) error {
+	tiles, err := r.painter.TilesIn(area)
+	if err != nil {
+		return err
+	}
+	for _, t := range tiles {
+		r.broadcast(nil, painter.Message{Seq: seq, Payload: t}, tileRect(t))
+	}
+	return nil
+}
+
+func tileRect(t painter.TileOP) image.Rectangle {
+	return image.Rect(t.X, t.Y, t.X+t.Width, t.Y+t.Height)
+}
+
+// persist appends m to the store op log and to the recording
+func (r *Room) persist(m painter.Message) error {
+	if r.recorder != nil {
+		if err := r.recorder.Record(m); err != nil {
+			log.Println("recording error", r.name, err)
+		}
+	}
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Append(m)
+}
+
+// Record starts writing every accepted message to w, beginning with a
+// snapshot of the current canvas, w is closed with the room
+func (r *Room) Record(w io.WriteCloser) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := painter.NewRecorder(w)
+	msgs, err := r.painter.Snapshot()
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		m.Seq = r.seq
+		if err := rec.Record(m); err != nil {
+			return err
+		}
+	}
+	r.recording = w
+	r.recorder = rec
+	return nil
+}
+
+// broadcast sends m to every client except from that sees area, encoding
+// it once per codec
+func (r *Room) broadcast(from *Cli, m painter.Message, area image.Rectangle) {
+	encoded := map[painter.Codec][]byte{}
+	for cl := range r.clients {
+		if cl == from || !cl.sees(area) {
+			continue
+		}
+		buf, ok := encoded[cl.codec]
+		if !ok {
+			var err error
+			buf, err = cl.codec.Marshal(m)
+			if err != nil {
+				log.Println("Erro: encoding message", err)
+				return
+			}
+			encoded[cl.codec] = buf
+		}
+		// A closed client is already on its way out
+		err := cl.send(buf)
+		if err != nil && err != errClientClosed {
+			log.Println("Erro: sending to cli", err)
+		}
+	}
+}
+
+func (r *Room) Snapshot() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		// Close wrote the last one
+		return nil
+	}
+	return r.snapshot()
+}
+
+func (r *Room) snapshot() error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Snapshot(r.painter)
+}
+
+// Close disconnects the clients with a close frame, writes a final
+// snapshot and closes the store
+func (r *Room) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	for cl := range r.clients {
+		cl.shutdown(websocket.CloseGoingAway, "room closed")
+	}
+	if r.recording != nil {
+		if err := r.recording.Close(); err != nil {
+			log.Println("error closing recording", r.name, err)
+		}
+	}
+	if err := r.snapshot(); err != nil {
+		return err
+	}
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Close()
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"image"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+const (
+	defaultRoom = "default"
+	// maxMessageSize bounds what a client can send in one message, enough
+	// for an ImageOP base64 encoded in JSON
+	maxMessageSize = painter.MaxImageBytes*4/3 + 64<<10
+)
+
+var validRoomName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+var (
+	errServerClosed = errors.New("server closed")
+	errNoRoom       = errors.New("no such room")
+	errRateLimited  = errors.New("too many operations")
+)
+
+// Config for CanvasServer
+type Config struct {
+	// DataDir stores each room in a sub directory, empty disables storage
+	DataDir       string
+	SnapshotEvery time.Duration
+	// Fonts available to text ops, nil for the embedded font only
+	Fonts painter.FontCache
+	// RecordDir appends every accepted message of a room to {name}.rec,
+	// empty disables recording
+	RecordDir string
+	// IdleTimeout is how long a room without clients is kept in memory
+	IdleTimeout time.Duration
+	// PingEvery is the keepalive interval, clients silent for twice as
+	// long are disconnected
+	PingEvery time.Duration
+	// OPRate is the number of ops per second a connection may send on
+	// average, with bursts of up to OPBurst
+	OPRate  float64
+	OPBurst int
+	// Auth decides the role of each connection, nil lets everyone draw
+	Auth Authenticator
+	// Origins are the pages allowed to connect, i.e. https://example.com,
+	// empty allows any or only the same origin if Auth reads cookies
+	Origins []string
+	// Audit gets a JSON line for every admin op, nil disables it
+	Audit io.Writer
+}
+
+// CanvasServer serves rooms at /room/{name}, / serves the default room,
+// /canvas/{name}.png and /thumb/{name}.png render them, admins of every
+// room get the rooms in memory at /rooms and metrics at /debug/vars
+type CanvasServer struct {
+	cfg      Config
+	mux      *http.ServeMux
+	upgrader websocket.Upgrader
+	audit    *auditLog
+
+	// mu guards rooms, bans and closed
+	mu    sync.Mutex
+	rooms map[string]*roomRef
+	// bans are the banned addresses of each room
+	bans   map[string]map[string]bool
+	closed bool
+	done   chan struct{}
+}
+
+// roomRef counts the connections using a room
+type roomRef struct {
+	*Room
+	refs      int
+	idleSince time.Time
+	// closing is set while an idle room is being closed, it is closed once
+	// the room is out of rooms and its store released
+	closing chan struct{}
+}
+
+func NewCanvasServer(cfg Config) *CanvasServer {
+	if cfg.SnapshotEvery <= 0 {
+		cfg.SnapshotEvery = time.Minute
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 10 * time.Minute
+	}
+	if cfg.PingEvery <= 0 {
+		cfg.PingEvery = 30 * time.Second
+	}
+	if cfg.OPRate <= 0 {
+		cfg.OPRate = 100
+	}
+	if cfg.OPBurst <= 0 {
+		cfg.OPBurst = 200
+	}
+	if cfg.Auth == nil {
+		cfg.Auth = OpenAuth(painter.RoleDraw)
+	}
+	s := &CanvasServer{
+		cfg:   cfg,
+		mux:   http.NewServeMux(),
+		rooms: map[string]*roomRef{},
+		bans:  map[string]map[string]bool{},
+		done:  make(chan struct{}),
+		upgrader: websocket.Upgrader{
+			CheckOrigin:  cfg.checkOrigin,
+			Subprotocols: subprotocols(),
+		},
+		audit: newAuditLog(cfg.Audit),
+	}
+	if err := s.loadBans(); err != nil {
+		log.Println("error loading bans", err)
+	}
+	s.mux.Handle("/rooms", s.adminOnly(http.HandlerFunc(s.serveRooms)))
+	s.mux.Handle("/debug/vars", s.adminOnly(expvar.Handler()))
+	s.mux.HandleFunc("/canvas/", s.serveCanvas)
+	s.mux.HandleFunc("/thumb/", s.serveThumb)
+	s.mux.HandleFunc("/room/", func(w http.ResponseWriter, r *http.Request) {
+		s.serveRoom(w, r, strings.TrimPrefix(r.URL.Path, "/room/"))
+	})
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		s.serveRoom(w, r, defaultRoom)
+	})
+	go s.run()
+	return s
+}
+
+func (s *CanvasServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// run snapshots rooms and frees the idle ones until Close
+func (s *CanvasServer) run() {
+	snapshot := time.NewTicker(s.cfg.SnapshotEvery)
+	defer snapshot.Stop()
+	idle := time.NewTicker(s.cfg.IdleTimeout / 2)
+	defer idle.Stop()
+	for {
+		select {
+		case <-snapshot.C:
+			for _, r := range s.roomList() {
+				if err := r.Snapshot(); err != nil {
+					log.Println("snapshot error", r.name, err)
+				}
+			}
+		case <-idle.C:
+			s.freeIdle()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// roomList returns the rooms in memory but the ones being closed
+func (s *CanvasServer) roomList() []*roomRef {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]*roomRef, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		if r.closing == nil {
+			ret = append(ret, r)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+// freeIdle closes the rooms without clients for IdleTimeout, they stay in
+// rooms until closed so acquire doesn't open their store meanwhile
+func (s *CanvasServer) freeIdle() {
+	s.mu.Lock()
+	freed := []*roomRef{}
+	for _, r := range s.rooms {
+		if s.closed {
+			// Close takes care of them
+			break
+		}
+		if r.closing == nil && r.refs == 0 && time.Since(r.idleSince) >= s.cfg.IdleTimeout {
+			r.closing = make(chan struct{})
+			freed = append(freed, r)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, r := range freed {
+		log.Println("freeing idle room", r.name)
+		if err := r.Close(); err != nil {
+			log.Println("error closing room", r.name, err)
+		}
+		s.mu.Lock()
+		delete(s.rooms, r.name)
+		close(r.closing)
+		s.mu.Unlock()
+	}
+}
+
+// acquire returns the named room, loading it if needed, the room is kept
+// in memory until release, rooms neither in memory nor stored are created
+// only if create is set, errNoRoom otherwise
+func (s *CanvasServer) acquire(name string, create bool) (*roomRef, error) {
+	if !validRoomName.MatchString(name) {
+		return nil, errors.New("invalid room name")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[name]
+	for ok && r.closing != nil {
+		closing := r.closing
+		s.mu.Unlock()
+		<-closing
+		s.mu.Lock()
+		r, ok = s.rooms[name]
+	}
+	if s.closed {
+		return nil, errServerClosed
+	}
+	if !ok && !create && !s.stored(name) {
+		return nil, errNoRoom
+	}
+	if !ok {
+		var store *Store
+		if s.cfg.DataDir != "" {
+			var err error
+			store, err = OpenStore(filepath.Join(s.cfg.DataDir, name))
+			if err != nil {
+				return nil, err
+			}
+		}
+		room, err := NewRoom(name, store, s.cfg.Fonts)
+		if err != nil {
+			if store != nil {
+				store.Close()
+			}
+			return nil, err
+		}
+		if s.cfg.RecordDir != "" {
+			if err := s.record(room); err != nil {
+				room.Close()
+				return nil, err
+			}
+		}
+		r = &roomRef{Room: room}
+		s.rooms[name] = r
+	}
+	r.refs++
+	return r, nil
+}
+
+// stored reports whether the named room has a store in DataDir
+func (s *CanvasServer) stored(name string) bool {
+	if s.cfg.DataDir == "" {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(s.cfg.DataDir, name))
+	return err == nil && fi.IsDir()
+}
+
+func (s *CanvasServer) record(room *Room) error {
+	if err := os.MkdirAll(s.cfg.RecordDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(
+		filepath.Join(s.cfg.RecordDir, room.name+".rec"),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	if err := room.Record(f); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *CanvasServer) release(r *roomRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.refs--
+	if r.refs == 0 {
+		r.idleSince = time.Now()
+	}
+}
+
+// Close stops accepting clients, disconnects the current ones with a close
+// frame and writes a final snapshot of every room
+func (s *CanvasServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	closing := []chan struct{}{}
+	for _, r := range s.rooms {
+		if r.closing != nil {
+			closing = append(closing, r.closing)
+		}
+	}
+	s.mu.Unlock()
+
+	close(s.done)
+	var ret error
+	for _, r := range s.roomList() {
+		if err := r.Close(); err != nil {
+			ret = err
+		}
+	}
+	// Rooms freed meanwhile are done once their snapshot is written
+	for _, c := range closing {
+		<-c
+	}
+	return ret
+}
+
+// checkOrigin allows the configured Origins, cookies are sent whatever page
+// opens the socket so without Origins only the same origin is allowed if
+// Auth reads them, requests without Origin don't come from a browser
+func (cfg Config) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(cfg.Origins) == 0 {
+		if !cookieAuth(cfg.Auth) {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range cfg.Origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func subprotocols() []string {
+	ret := []string{}
+	for _, c := range painter.Codecs {
+		ret = append(ret, string(c))
+	}
+	return ret
+}
+
+// authorize returns the address and role of a request to room, if it is
+// refused the error response is written and ok is false
+func (s *CanvasServer) authorize(w http.ResponseWriter, r *http.Request, room string) (addr string, role uint8, ok bool) {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if s.banned(room, addr) {
+		http.Error(w, "banned", http.StatusForbidden)
+		return "", 0, false
+	}
+	role, err = s.cfg.Auth.Authenticate(r, room)
+	if err != nil {
+		log.Println("auth err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return "", 0, false
+	}
+	if role == 0 {
+		http.Error(w, errNotAllowed.Error(), http.StatusForbidden)
+		return "", 0, false
+	}
+	return addr, role, true
+}
+
+// adminOnly serves h to requests authorized as admin of any room
+func (s *CanvasServer) adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, role, ok := s.authorize(w, r, anyRoom)
+		if !ok {
+			return
+		}
+		if role < painter.RoleAdmin {
+			http.Error(w, errNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *CanvasServer) serveRoom(w http.ResponseWriter, r *http.Request, name string) {
+	log.Println("Receiving connection from:", r.RemoteAddr, "room:", name)
+	if !websocket.IsWebSocketUpgrade(r) {
+		// Before acquire, plain requests don't create rooms
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+	addr, role, ok := s.authorize(w, r, name)
+	if !ok {
+		return
+	}
+	room, err := s.acquire(name, true)
+	if err != nil {
+		log.Println("room err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer s.release(room)
+
+	c, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade err", err)
+		return
+	}
+	defer c.Close()
+	c.SetReadLimit(maxMessageSize)
+
+	ncli := newCli(c, painter.ParseCodec(c.Subprotocol()), s.cfg.PingEvery)
+	defer ncli.close()
+	ncli.role = role
+	ncli.addr = addr
+	// ?name= picks the display name
+	ncli.presence = newPresence(ncli.id, r.URL.Query().Get("name"))
+	err = room.join(ncli)
+	if err != nil {
+		log.Println("sending msg error", err)
+		return
+	}
+	defer room.leave(ncli)
+
+	limit := newTokenBucket(s.cfg.OPRate, s.cfg.OPBurst)
+	for {
+		mt, message, err := ncli.read()
+		if err != nil {
+			log.Println("Bye bye", r.RemoteAddr)
+			return
+		}
+		if mt != websocket.TextMessage && mt != websocket.BinaryMessage {
+			continue
+		}
+		m, err := painter.Decode(message)
+		if err != nil {
+			ncli.reject(0, err)
+			continue
+		}
+		if ncli.role < requiredRole(m.Payload) {
+			ncli.reject(m.Ref, errNotAllowed)
+			continue
+		}
+		// ops are always attributed to the connection
+		m.Payload = painter.SetAuthor(m.Payload, ncli.id)
+		allowed := limit.allow()
+		if o, ok := m.Payload.(painter.CursorOP); ok {
+			// Nobody waits for an answer, so the ones past the limit are
+			// dropped, the room throttles the rest
+			if !allowed {
+				continue
+			}
+			if err := room.cursor(ncli, o); err != nil {
+				ncli.reject(m.Ref, err)
+			}
+			continue
+		}
+		if !allowed {
+			ncli.reject(m.Ref, errRateLimited)
+			continue
+		}
+		switch o := m.Payload.(type) {
+		case painter.ViewOP:
+			err = room.view(ncli, o)
+		case painter.ClearOP:
+			err = room.clear(ncli)
+		case painter.KickOP:
+			err = room.kick(ncli, o.Target)
+		case painter.EraseOP:
+			err = room.erase(ncli, o)
+		case painter.BanOP:
+			err = s.ban(room, ncli, o.Target)
+		default:
+			// draw in server
+			err = room.apply(ncli, m)
+		}
+		if requiredRole(m.Payload) == painter.RoleAdmin {
+			s.audit.write(name, ncli, m.Payload, err)
+		}
+		if err != nil {
+			ncli.reject(m.Ref, err)
+		}
+	}
+}
+
+// RoomInfo is an entry of the /rooms listing, Extent is the drawn area
+type RoomInfo struct {
+	Name    string
+	Clients int
+	Extent  image.Rectangle
+}
+
+func (s *CanvasServer) serveRooms(w http.ResponseWriter, r *http.Request) {
+	ret := []RoomInfo{}
+	for _, room := range s.roomList() {
+		room.mu.Lock()
+		ret = append(ret, RoomInfo{
+			Name:    room.name,
+			Clients: len(room.clients),
+			Extent:  room.painter.Extent(),
+		})
+		room.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+func testServer(t *testing.T, cfg Config) (*CanvasServer, *httptest.Server) {
+	s := NewCanvasServer(cfg)
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() {
+		srv.Close()
+		s.Close()
+	})
+	return s, srv
+}
+
+func dial(t *testing.T, srv *httptest.Server, path string) *websocket.Conn {
+	d := websocket.Dialer{Subprotocols: []string{string(painter.CodecJSON)}}
+	c, _, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// readUntilError reads and discards messages until the connection fails
+func readUntilError(c *websocket.Conn, timeout time.Duration) error {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			return err
+		}
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	const ping = 100 * time.Millisecond
+	_, srv := testServer(t, Config{PingEvery: ping})
+
+	alive := dial(t, srv, "/room/ping")
+	start := time.Now()
+	silent := dial(t, srv, "/room/ping")
+	// Swallow the pings instead of answering them
+	silent.SetPingHandler(func(string) error { return nil })
+
+	// The default ping handler answers while reading
+	aliveErr := make(chan error, 1)
+	go func() { aliveErr <- readUntilError(alive, 5*ping) }()
+
+	err := readUntilError(silent, 10*ping)
+	if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+		t.Fatal("silent client wasn't dropped")
+	}
+	if d := time.Since(start); d < 2*ping {
+		t.Fatalf("silent client dropped after %v, before 2 pings", d)
+	}
+
+	err = <-aliveErr
+	if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+		t.Fatal("answering client was dropped:", err)
+	}
+}
+
+func TestCloseGoingAway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, srv := testServer(t, Config{DataDir: dir, SnapshotEvery: time.Hour})
+
+	c := dial(t, srv, "/room/close")
+	line := painter.Message{Ref: 1, Payload: painter.LineOP{
+		Color: color.RGBA{255, 0, 0, 255}, Width: 2, X1: 10, Y1: 10, X2: 50, Y2: 30,
+	}}
+	data, err := json.Marshal(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the ack so the line is applied before Close
+	if e, ok := waitRef(t, c, line.Ref).Payload.(painter.ErrorOP); ok {
+		t.Fatal("line rejected:", e)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = readUntilError(c, 5*time.Second)
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatal("expected a going away close frame, got", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "close", snapshotFile)); err != nil {
+		t.Fatal("no snapshot after Close:", err)
+	}
+	st, err := OpenStore(filepath.Join(dir, "close"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	p, err := painter.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Extent().Empty() {
+		t.Fatal("snapshot lost the line")
+	}
+}
+
+// waitRef returns the answer to the message with ref
+func waitRef(t *testing.T, c *websocket.Conn, ref uint32) painter.Message {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := painter.Decode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Ref == ref {
+			return m
+		}
+	}
+}
+
+func TestCursorRateLimit(t *testing.T) {
+	_, srv := testServer(t, Config{OPRate: 0.1, OPBurst: 5})
+	c := dial(t, srv, "/room/cursor")
+	write := func(m painter.Message) {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		write(painter.Message{Payload: painter.CursorOP{X: float64(i), Y: 10}})
+	}
+	write(painter.Message{Ref: 1, Payload: painter.LineOP{
+		Color: color.RGBA{255, 0, 0, 255}, Width: 2, X1: 10, Y1: 10, X2: 50, Y2: 30,
+	}})
+	m := waitRef(t, c, 1)
+	if e, ok := m.Payload.(painter.ErrorOP); !ok || e.Reason != errRateLimited.Error() {
+		t.Fatalf("line answered with %#v, want rate limited", m.Payload)
+	}
+}
+
+func TestPlainRequestNoRoom(t *testing.T) {
+	dir := testStore(t)
+	_, srv := testServer(t, Config{DataDir: dir})
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req, err := http.NewRequest(method, srv.URL+"/room/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", method, res.StatusCode)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "plain")); !os.IsNotExist(err) {
+		t.Error("plain request created a room store:", err)
+	}
+}
+
+func TestAcquireWaitsClosing(t *testing.T) {
+	s, _ := testServer(t, Config{DataDir: testStore(t)})
+	r, err := s.acquire("idle", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.release(r)
+	s.mu.Lock()
+	r.closing = make(chan struct{})
+	s.mu.Unlock()
+
+	got := make(chan *roomRef)
+	go func() {
+		r, err := s.acquire("idle", true)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- r
+	}()
+	select {
+	case <-got:
+		t.Fatal("acquired a room being closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// What freeIdle does once the room is closed
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	delete(s.rooms, "idle")
+	close(r.closing)
+	s.mu.Unlock()
+	select {
+	case r2 := <-got:
+		if r2 == nil || r2.Room == r.Room {
+			t.Fatal("closed room acquired again")
+		}
+		s.release(r2)
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire still waiting")
+	}
+}
+
+func TestBanScopedToRoom(t *testing.T) {
+	dir := testStore(t)
+	s := NewCanvasServer(Config{DataDir: dir})
+	s.mu.Lock()
+	s.bans["banned"] = map[string]bool{"127.0.0.1": true}
+	err := s.saveBans()
+	s.mu.Unlock()
+	s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, srv := testServer(t, Config{DataDir: dir})
+	dial(t, srv, "/room/other")
+	d := websocket.Dialer{Subprotocols: []string{string(painter.CodecJSON)}}
+	_, res, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/room/banned", nil)
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatal("banned address joined the room:", err)
+	}
+}
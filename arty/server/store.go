@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+const (
+	// snapshotFile holds the snapshot messages as a recording
+	snapshotFile = "snapshot.rec"
+	opLogFile    = "ops.log"
+)
+
+// Store persists a canvas in a directory as a snapshot of its tiles plus
+// an append only log of the operations applied since that snapshot, as
+// timestamped records so history knows when they were drawn
+type Store struct {
+	dir string
+	log *os.File
+	rec *painter.Recorder
+	// seq of the last message stored, the snapshot messages have the seq
+	// they cover so Load skips the log entries left by a crash before the
+	// log was truncated
+	seq uint64
+}
+
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	st := &Store{dir: dir}
+	if err := st.openLog(os.O_APPEND); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *Store) openLog(flag int) error {
+	f, err := os.OpenFile(
+		filepath.Join(st.dir, opLogFile),
+		os.O_CREATE|os.O_WRONLY|flag,
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+	st.log = f
+	st.rec = painter.NewRecorder(f)
+	return nil
+}
+
+// Load initializes p from the stored snapshot and replays the op log on
+// top of it, without a snapshot the log is replayed on a blank canvas, it
+// returns false if nothing was stored
+func (st *Store) Load(p *painter.BufPainter) (bool, error) {
+	f, err := os.Open(filepath.Join(st.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		// Stopped before the first snapshot, the log has everything
+		p.Init(painter.InitOP{})
+		return st.replay(p, 0)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	rd := painter.NewRecordReader(bufio.NewReader(f))
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		st.seq = rec.Message.Seq
+		if err := p.HandleOP(rec.Message.Payload); err != nil {
+			return false, err
+		}
+	}
+	_, err = st.replay(p, st.seq)
+	return true, err
+}
+
+// Seq returns the seq of the last message stored
+func (st *Store) Seq() uint64 {
+	return st.seq
+}
+
+// replay handles the op log on p but the entries up to the covered seq, it
+// returns false if the log is empty
+func (st *Store) replay(p *painter.BufPainter, covered uint64) (bool, error) {
+	f, err := os.Open(filepath.Join(st.dir, opLogFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	replayed := false
+	rd := painter.NewRecordReader(bufio.NewReader(f))
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Probably a partial write on crash, keep what we have
+			log.Println("store: stopping op log replay:", err)
+			return replayed, nil
+		}
+		replayed = true
+		if covered > 0 && rec.Message.Seq <= covered {
+			// Already in the snapshot
+			continue
+		}
+		st.seq = rec.Message.Seq
+		if err := p.HandleOPAt(rec.Message.Payload, rec.Time); err != nil {
+			log.Println("store: replay:", err)
+		}
+	}
+	return replayed, nil
+}
+
+// Append writes an applied operation to the op log, its seq must be above
+// the stored ones
+func (st *Store) Append(m painter.Message) error {
+	if err := st.rec.Record(m); err != nil {
+		return err
+	}
+	st.seq = m.Seq
+	return nil
+}
+
+// Snapshot writes the canvas tiles to disk and truncates the op log, the
+// snapshot replaces the previous one at once and has the seq of the last
+// op appended
+func (st *Store) Snapshot(p *painter.BufPainter) error {
+	msgs, err := p.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(st.dir, snapshotFile), func(w io.Writer) error {
+		rec := painter.NewRecorder(w)
+		for _, m := range msgs {
+			m.Seq = st.seq
+			if err := rec.Record(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := st.log.Close(); err != nil {
+		return err
+	}
+	return st.openLog(os.O_TRUNC)
+}
+
+// writeFile writes name through a temporary file so it is replaced at once
+func writeFile(name string, fn func(w io.Writer) error) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (st *Store) Close() error {
+	return st.log.Close()
+}
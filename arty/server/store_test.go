@@ -0,0 +1,176 @@
+package main
+
+import (
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stdiopt/gowasm-experiments/arty/painter"
+)
+
+func testStore(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "arty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func loadStore(t *testing.T, dir string) (*painter.BufPainter, bool) {
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	p, err := painter.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.EnableHistory()
+	loaded, err := st.Load(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, loaded
+}
+
+func TestStoreEmpty(t *testing.T) {
+	if _, loaded := loadStore(t, testStore(t)); loaded {
+		t.Fatal("empty store loaded")
+	}
+}
+
+func TestStoreLogWithoutSnapshot(t *testing.T) {
+	dir := testStore(t)
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := painter.LineOP{Color: color.RGBA{255, 0, 0, 255}, Width: 2, X1: 10, Y1: 10, X2: 50, Y2: 30}
+	if err := st.Append(painter.Message{Seq: 1, Payload: line}); err != nil {
+		t.Fatal(err)
+	}
+	// No Snapshot, as if the server crashed
+	st.Close()
+
+	p, loaded := loadStore(t, dir)
+	if !loaded {
+		t.Fatal("op log not loaded")
+	}
+	if p.Extent().Empty() {
+		t.Fatal("op log not replayed")
+	}
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	dir := testStore(t)
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := painter.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Init(painter.InitOP{})
+	ops := []painter.LineOP{
+		{Color: color.RGBA{255, 0, 0, 255}, Width: 2, X1: 10, Y1: 10, X2: 50, Y2: 30},
+		{Color: color.RGBA{0, 0, 255, 255}, Width: 2, X1: 300, Y1: 10, X2: 350, Y2: 30},
+	}
+	for i, op := range ops {
+		if err := p.HandleOP(op); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.Append(painter.Message{Seq: uint64(i + 1), Payload: op}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := st.Snapshot(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	st.Close()
+
+	got, loaded := loadStore(t, dir)
+	if !loaded {
+		t.Fatal("snapshot not loaded")
+	}
+	if got.Extent() != p.Extent() {
+		t.Fatalf("extent %v, want %v", got.Extent(), p.Extent())
+	}
+	r := p.Extent()
+	if string(got.Region(r).Pix) != string(p.Region(r).Pix) {
+		t.Fatal("restored canvas differs")
+	}
+}
+
+func TestStoreSnapshotBeforeTruncate(t *testing.T) {
+	dir := testStore(t)
+	st, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := painter.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Init(painter.InitOP{})
+	// Drawing it twice would darken it
+	rect := painter.RectOP{Color: color.RGBA{0, 0, 255, 128}, Fill: true, X1: 10, Y1: 10, X2: 50, Y2: 50}
+	if err := p.HandleOP(rect); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Append(painter.Message{Seq: 1, Payload: rect}); err != nil {
+		t.Fatal(err)
+	}
+	logged, err := ioutil.ReadFile(filepath.Join(dir, opLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Snapshot(p); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	// As if the server crashed before truncating the log
+	if err := ioutil.WriteFile(filepath.Join(dir, opLogFile), logged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := painter.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Load(got); err != nil {
+		t.Fatal(err)
+	}
+	if st.Seq() != 1 {
+		t.Fatalf("seq %d after load, want 1", st.Seq())
+	}
+	r := p.Extent()
+	if string(got.Region(r).Pix) != string(p.Region(r).Pix) {
+		t.Fatal("op in the snapshot replayed again")
+	}
+
+	// Ops after the snapshot are still replayed
+	line := painter.LineOP{Color: color.RGBA{255, 0, 0, 255}, Width: 2, X1: 300, Y1: 10, X2: 350, Y2: 30}
+	if err := st.Append(painter.Message{Seq: st.Seq() + 1, Payload: line}); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	if err := p.HandleOP(line); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = loadStore(t, dir)
+	r = p.Extent()
+	if got.Extent() != r || string(got.Region(r).Pix) != string(p.Region(r).Pix) {
+		t.Fatal("op after the snapshot not replayed")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/stdiopt/gowasm-experiments
 
-go 1.13
+go 1.16
 
 require (
 	github.com/ByteArena/box2d v1.0.2
@@ -9,4 +9,5 @@ require (
 	github.com/llgcode/draw2d v0.0.0-20180825133448-f52c8a71aff0
 	github.com/lucasb-eyer/go-colorful v1.0.2
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/image v0.0.0-20180708004352-c73c2afc3b81
 )